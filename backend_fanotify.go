@@ -0,0 +1,786 @@
+//go:build linux && !appengine
+
+package fsnotify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify/internal"
+	"golang.org/x/sys/unix"
+)
+
+// fanotify is a backend using fanotify(7) with FAN_REPORT_DFID_NAME, which
+// reports a file handle for the directory and the filename for every event.
+//
+// Unlike inotify this can mark an entire mount or filesystem with a single
+// mark, which is what we use for recursive watches. Paths for these events are
+// looked up with open_by_handle_at(), which requires CAP_DAC_READ_SEARCH.
+type fanotify struct {
+	*shared
+	Events chan Event
+	Errors chan error
+
+	fd       int
+	file     *os.File
+	doneResp chan struct{} // Channel to respond to Close
+	noRename bool          // FAN_RENAME isn't supported (needs Linux 5.17).
+
+	marks    map[string]*fanMark // path → mark
+	handles  map[string]*fanMark // file handle → inode mark
+	fsMarks  map[string]*fanMark // path → mount or filesystem mark
+	resolved map[string]string   // file handle → last known path of directory
+}
+
+type fanMark struct {
+	path    string   // Path as added.
+	abs     string   // Absolute path, for recursive watches and mount and filesystem marks.
+	kind    markKind // Mark on the inode, mount, or filesystem.
+	recurse bool     // Recursive watch, using a filesystem mark.
+	isDir   bool
+	op      Op
+	mask    uint64   // Mask as added to the kernel.
+	handle  string   // File handle of path.
+	key     string   // Marks with the same key share a kernel mark.
+	fsid    [2]int32 // Filesystem ID.
+	fd      int      // fd for open_by_handle_at() for mount and filesystem marks, or -1.
+}
+
+// Information records for a single fanotify event.
+type (
+	fanInfo struct {
+		typ    uint8
+		fsid   [2]int32
+		handle string // Handle type and bytes, as map key.
+		htype  int32
+		hbytes []byte
+		name   string
+	}
+	fanInfos struct{ dir, fid, old, new fanInfo }
+)
+
+func newFanotifyBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
+	// Need to set nonblocking mode for SetDeadline to work, otherwise blocking
+	// I/O operations won't terminate on close.
+	fd, err := unix.FanotifyInit(
+		unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME|unix.FAN_REPORT_FID,
+		unix.O_RDONLY|unix.O_CLOEXEC|unix.O_LARGEFILE)
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: initializing fanotify: %w", fanotifyLimitError(err))
+	}
+
+	w := &fanotify{
+		shared:   newShared(ev, errs, seq),
+		Events:   ev,
+		Errors:   errs,
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), ""),
+		doneResp: make(chan struct{}),
+		marks:    make(map[string]*fanMark),
+		handles:  make(map[string]*fanMark),
+		fsMarks:  make(map[string]*fanMark),
+		resolved: make(map[string]string),
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+func isFanotify(b backend) bool {
+	_, ok := b.(*fanotify)
+	return ok
+}
+
+func fanotifyLimitError(err error) error {
+	return limitError(err, "fanotify.max_user_marks", "fanotify.max_user_groups")
+}
+
+func (w *fanotify) watchCount() (total, user int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.marks), len(w.marks)
+}
+
+func (w *fanotify) Close() error {
+	if w.shared.close() {
+		return nil
+	}
+
+	// Closing the fanotify fd removes all the marks. This is done with the
+	// lock held, so that nothing uses the fd after it's closed: the fd number
+	// may be reused by another Watcher right away.
+	w.mu.Lock()
+	err := w.file.Close()
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	for _, m := range w.marks {
+		w.dropMark(m)
+	}
+	w.mu.Unlock()
+
+	<-w.doneResp // Wait for readEvents() to finish.
+	return nil
+}
+
+func (w *fanotify) Add(name string) error { return w.AddWith(name) }
+
+func (w *fanotify) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if w.log.enabled() {
+		w.log.watch("AddWith", path)
+	}
+
+	with := getOptions(opts...)
+	if !w.Supports(with.op) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, with.op)
+	}
+	path, recurse := recursivePath(path)
+	if recurse {
+		if with.mark == markMount {
+			return fmt.Errorf("%w: recursive watch with a mount mark", ErrUnsupported)
+		}
+		with.mark = markFilesystem
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	op := w.filters.ops(path, with)
+	if m, ok := w.marks[path]; ok {
+		if m.kind != with.mark || m.recurse != recurse {
+			return fmt.Errorf("fsnotify: %q is already added with a different mark", path)
+		}
+		op |= m.op
+	} else if err := checkMaxWatches(len(w.marks), w.maxWatches); err != nil {
+		return err
+	}
+
+	m, err := w.newMark(path, with.mark, recurse, op)
+	if err != nil {
+		return err
+	}
+	root, frecurse := m.filterRoot()
+	w.filters.set(root, frecurse, newPathFilter(with), with)
+	err = w.addMark(m)
+	if err != nil {
+		w.filters.remove(root)
+		if m.fd != -1 {
+			unix.Close(m.fd)
+		}
+		return err
+	}
+
+	if old, ok := w.marks[path]; ok {
+		w.dropMark(old)
+	}
+	w.marks[m.path] = m
+	if m.kind == markInode {
+		w.handles[m.handle] = m
+	} else {
+		w.fsMarks[m.path] = m
+	}
+	if w.queueExisting(root, frecurse, with) {
+		// Wake up readEvents() to send them.
+		_ = w.file.SetReadDeadline(time.Now())
+	}
+	return nil
+}
+
+// Get the path to use for filters; events for mount and filesystem marks use
+// absolute paths.
+func (m *fanMark) filterRoot() (string, bool) {
+	if m.kind != markInode && !m.recurse {
+		return m.abs, true
+	}
+	return m.path, m.recurse
+}
+
+func (w *fanotify) newMark(path string, kind markKind, recurse bool, op Op) (*fanMark, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if recurse && !fi.IsDir() {
+		return nil, fmt.Errorf("fsnotify: not a directory: %q", path)
+	}
+	h, mountID, err := unix.NameToHandleAt(unix.AT_FDCWD, path, 0)
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: getting file handle for %q: %w", path, err)
+	}
+	var st unix.Statfs_t
+	err = unix.Statfs(path, &st)
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: statfs %q: %w", path, err)
+	}
+
+	m := &fanMark{
+		path:    path,
+		kind:    kind,
+		recurse: recurse,
+		isDir:   fi.IsDir(),
+		op:      op,
+		handle:  handleKey(h.Type(), h.Bytes()),
+		fsid:    st.Fsid.Val,
+		fd:      -1,
+	}
+	switch kind {
+	case markInode:
+		m.key = m.handle
+	case markMount:
+		m.key = "mount:" + strconv.Itoa(mountID)
+	case markFilesystem:
+		m.key = fmt.Sprintf("fs:%x", m.fsid)
+	}
+	if recurse || kind != markInode {
+		m.abs, err = filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if kind != markInode {
+		// Can't use O_PATH: open_by_handle_at() doesn't accept it.
+		m.fd, err = unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("fsnotify: open %q: %w", path, err)
+		}
+	}
+	return m, nil
+}
+
+// Add the mark to the kernel; this is a no-op if the mask is already set.
+func (w *fanotify) addMark(m *fanMark) error {
+	if w.isClosed() { // The fd may be closed.
+		return ErrClosed
+	}
+	for {
+		m.mask = fanotifyMask(m.op, m.kind, m.isDir, !w.noRename)
+		err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|m.kind.flag(), m.mask, unix.AT_FDCWD, m.path)
+		if err != nil && errors.Is(err, unix.EINVAL) && m.mask&unix.FAN_RENAME != 0 {
+			w.noRename = true // Linux <5.17; use FAN_MOVED_{FROM,TO} instead.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("fsnotify: fanotify_mark %q: %w", m.path, fanotifyLimitError(err))
+		}
+		return nil
+	}
+}
+
+func (k markKind) flag() uint {
+	switch k {
+	case markMount:
+		return unix.FAN_MARK_MOUNT
+	case markFilesystem:
+		return unix.FAN_MARK_FILESYSTEM
+	default:
+		return unix.FAN_MARK_INODE
+	}
+}
+
+// Get the fanotify mask for the operations.
+func fanotifyMask(op Op, kind markKind, isDir, rename bool) uint64 {
+	var mask uint64
+	if op.Has(Write) {
+		mask |= unix.FAN_MODIFY
+	}
+	if op.Has(UnportableOpen) {
+		mask |= unix.FAN_OPEN
+	}
+	if op.Has(UnportableRead) {
+		mask |= unix.FAN_ACCESS
+	}
+	if op.Has(UnportableCloseWrite) {
+		mask |= unix.FAN_CLOSE_WRITE
+	}
+	if op.Has(UnportableCloseRead) {
+		mask |= unix.FAN_CLOSE_NOWRITE
+	}
+	// Mount marks don't support any of the events for directory entries or
+	// attributes.
+	if kind == markMount {
+		return mask
+	}
+
+	if op.Has(Chmod) {
+		mask |= unix.FAN_ATTRIB
+	}
+	if isDir || kind == markFilesystem {
+		mask |= unix.FAN_ONDIR
+		if op.Has(Create) {
+			mask |= unix.FAN_CREATE
+		}
+		if op.Has(Remove) {
+			mask |= unix.FAN_DELETE
+		}
+		switch {
+		case op.Has(Create|Rename) && rename:
+			mask |= unix.FAN_RENAME
+		case op.Has(Create | Rename):
+			mask |= unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO
+		}
+	}
+	if kind == markInode {
+		// Always set so we can remove the watch.
+		mask |= unix.FAN_DELETE_SELF | unix.FAN_MOVE_SELF
+		if isDir {
+			mask |= unix.FAN_EVENT_ON_CHILD
+		}
+	}
+	return mask
+}
+
+func handleKey(typ int32, h []byte) string {
+	return string(append(binary.NativeEndian.AppendUint32(nil, uint32(typ)), h...))
+}
+
+// Remove from our state; doesn't remove the kernel mark.
+func (w *fanotify) dropMark(m *fanMark) {
+	if w.marks[m.path] == m {
+		delete(w.marks, m.path)
+	}
+	if w.handles[m.handle] == m {
+		delete(w.handles, m.handle)
+	}
+	if w.fsMarks[m.path] == m {
+		delete(w.fsMarks, m.path)
+	}
+	if m.fd != -1 {
+		unix.Close(m.fd)
+		m.fd = -1
+	}
+}
+
+func (w *fanotify) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if w.log.enabled() {
+		w.log.watch("Remove", name)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	path, recurse := recursivePath(name)
+	m, ok := w.marks[path]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, path)
+	}
+	if recurse && !m.recurse {
+		return fmt.Errorf("can't use /... with non-recursive watch %q", path)
+	}
+	root, _ := m.filterRoot()
+	w.filters.remove(root)
+	return w.remove(m)
+}
+
+func (w *fanotify) remove(m *fanMark) error {
+	if w.isClosed() { // The fd may be closed.
+		return nil
+	}
+	// Multiple watches may share the same kernel mark (e.g. two recursive
+	// watches on the same filesystem); only remove what no other watch needs.
+	var keep uint64
+	for _, o := range w.marks {
+		if o != m && o.key == m.key {
+			keep |= o.mask
+		}
+	}
+	rm := m.mask &^ keep
+	dirFd, p := unix.AT_FDCWD, m.path
+	if m.fd != -1 {
+		dirFd, p = m.fd, ""
+	}
+	var err error
+	if rm != 0 {
+		err = unix.FanotifyMark(w.fd, unix.FAN_MARK_REMOVE|m.kind.flag(), rm, dirFd, p)
+		if errors.Is(err, unix.ENOENT) { // Already removed by the kernel.
+			err = nil
+		}
+	}
+	w.dropMark(m)
+	return err
+}
+
+func (w *fanotify) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.marks))
+	for _, m := range w.marks {
+		if m.recurse {
+			entries = append(entries, filepath.Join(m.path, "..."))
+		} else {
+			entries = append(entries, m.path)
+		}
+	}
+	return entries
+}
+
+func (w *fanotify) Supports(op Op) bool {
+	return op&(UnportableUnwatch|UnportableUnmount) == 0
+}
+
+// readEvents reads from the fanotify file descriptor, converts the received
+// events into Event objects and sends them via the Events channel.
+func (w *fanotify) readEvents() {
+	defer func() {
+		close(w.doneResp)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	var (
+		buf [65536]byte
+		evs = make([]Event, 0, 8) // Events to send for a single fanotify event.
+	)
+	for {
+		if w.isClosed() {
+			return
+		}
+
+		n, err := w.file.Read(buf[:])
+		wakeup := errors.Is(err, os.ErrDeadlineExceeded) // Woken up by AddWith() for WithExisting().
+		if wakeup {
+			_ = w.file.SetReadDeadline(time.Time{})
+		}
+		if !w.sendExisting() {
+			return
+		}
+		if wakeup {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if !w.sendError(err) {
+				return
+			}
+			continue
+		}
+		read := time.Now()
+		w.stats.bytes.Add(uint64(n))
+		if n < unix.FAN_EVENT_METADATA_LEN {
+			err := errors.New("fsnotify: short read in readEvents()")
+			if n == 0 {
+				err = io.EOF // This should really never happen.
+			}
+			if !w.sendError(err) {
+				return
+			}
+			continue
+		}
+
+		for offset := 0; offset+unix.FAN_EVENT_METADATA_LEN <= n; {
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			end := offset + int(meta.Event_len)
+			if meta.Event_len < unix.FAN_EVENT_METADATA_LEN || end > n {
+				break
+			}
+			w.stats.read.Add(1)
+			if meta.Vers != unix.FANOTIFY_METADATA_VERSION {
+				w.sendError(fmt.Errorf("fsnotify: unknown fanotify metadata version %d", meta.Vers))
+				return
+			}
+			if meta.Fd >= 0 { // Should never happen with FAN_REPORT_FID.
+				unix.Close(int(meta.Fd))
+			}
+			if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				if !w.sendError(ErrEventOverflow) {
+					return
+				}
+			}
+
+			evs = w.handleEvent(meta.Mask, parseFanInfo(buf[offset+int(meta.Metadata_len):end]), evs[:0])
+			for _, ev := range evs {
+				ev.Time = read
+				if !w.sendEvent(ev) {
+					return
+				}
+			}
+			offset = end
+		}
+	}
+}
+
+func parseFanInfo(b []byte) fanInfos {
+	var infos fanInfos
+	for len(b) >= 20 {
+		l := int(binary.NativeEndian.Uint16(b[2:4]))
+		if l < 20 || l > len(b) {
+			break
+		}
+		rec := b[:l]
+		b = b[l:]
+
+		hb := int(binary.NativeEndian.Uint32(rec[12:16]))
+		if 20+hb > l {
+			continue
+		}
+		info := fanInfo{
+			typ:    rec[0],
+			fsid:   [2]int32{int32(binary.NativeEndian.Uint32(rec[4:8])), int32(binary.NativeEndian.Uint32(rec[8:12]))},
+			handle: string(rec[16 : 20+hb]),
+			htype:  int32(binary.NativeEndian.Uint32(rec[16:20])),
+			hbytes: rec[20 : 20+hb],
+		}
+		if name := rec[20+hb:]; len(name) > 0 {
+			if i := bytes.IndexByte(name, 0); i > -1 {
+				name = name[:i]
+			}
+			info.name = string(name)
+		}
+
+		switch info.typ {
+		case unix.FAN_EVENT_INFO_TYPE_DFID_NAME, unix.FAN_EVENT_INFO_TYPE_DFID:
+			infos.dir = info
+		case unix.FAN_EVENT_INFO_TYPE_FID:
+			infos.fid = info
+		case unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME:
+			infos.old = info
+		case unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+			infos.new = info
+		}
+	}
+	return infos
+}
+
+// handleEvent converts the fanotify event to zero or more Events, which are
+// appended to evs.
+func (w *fanotify) handleEvent(mask uint64, infos fanInfos, evs []Event) []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if mask&unix.FAN_RENAME != 0 {
+		from, fromOp, fromOk := w.eventPath(infos.old, fanInfo{})
+		to, toOp, toOk := w.eventPath(infos.new, fanInfo{})
+		if w.log.enabled() {
+			w.log.event(internal.DebugFanotify(from, unix.FAN_RENAME), from, internal.FanotifyMask(unix.FAN_RENAME), unix.FAN_RENAME, 0)
+			w.log.event(internal.DebugFanotify(to, unix.FAN_RENAME), to, internal.FanotifyMask(unix.FAN_RENAME), unix.FAN_RENAME, 0)
+		}
+		isDir := mask&unix.FAN_ONDIR != 0
+		if fromOk {
+			evs = append(evs, Event{Name: from, Op: Rename & fromOp, IsDir: isDir})
+			if m, ok := w.fsMarks[from]; ok && m.recurse {
+				if !w.sendError(watchError("remove", m.path, w.remove(m))) {
+					return evs
+				}
+			}
+		} else {
+			from = ""
+		}
+		if toOk {
+			evs = append(evs, Event{Name: to, Op: Create & toOp, RenamedFrom: from, IsDir: isDir})
+		}
+		if isDir {
+			w.renameResolved(infos.old, infos.new)
+		}
+		mask &^= unix.FAN_RENAME
+	}
+	if mask&^(unix.FAN_ONDIR|unix.FAN_Q_OVERFLOW) == 0 {
+		return evs
+	}
+
+	name, op, ok := w.eventPath(infos.dir, infos.fid)
+	if !ok {
+		return evs
+	}
+	if w.log.enabled() {
+		w.log.event(internal.DebugFanotify(name, mask), name, internal.FanotifyMask(mask), mask, 0)
+	}
+
+	// The watched path itself was removed or moved: remove the watch. The
+	// kernel removes the mark on deletes; we can't remove the mark on moves as
+	// the path is no longer valid, but nothing will be sent for it.
+	if mask&(unix.FAN_DELETE_SELF|unix.FAN_MOVE_SELF) != 0 {
+		m := w.handles[infos.fid.handle]
+		if m == nil && infos.dir.name == "." {
+			m = w.handles[infos.dir.handle]
+		}
+		if m != nil {
+			w.dropMark(m)
+			// Skip if we're watching both this path and the parent; the parent
+			// will already send a delete so no need to do it twice.
+			if p, ok := w.marks[filepath.Dir(m.path)]; ok && p.kind == markInode {
+				mask &^= unix.FAN_DELETE_SELF
+			}
+		}
+	}
+
+	evs = fanotifyEvents(evs, name, mask, op)
+
+	// Recursive watches use a filesystem mark, which stays valid if the root
+	// is moved or removed. Remove the watch to be consistent with inotify.
+	if mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0 {
+		if m, ok := w.fsMarks[name]; ok && m.recurse {
+			if !w.sendError(watchError("remove", m.path, w.remove(m))) {
+				return evs
+			}
+		}
+	}
+	return evs
+}
+
+// Get the path for the event and the operations the watches want, or false if
+// the path isn't watched.
+//
+// dir is the directory the event happened in (the entry name is in dir.name),
+// and fid the file or directory itself, if known.
+func (w *fanotify) eventPath(dir, fid fanInfo) (string, Op, bool) {
+	var (
+		path  string
+		op    Op
+		found bool
+		self  = dir.name == "." || dir.name == ""
+	)
+	if m, ok := w.handles[dir.handle]; ok && m.isDir && dir.typ != 0 {
+		path, op, found = m.path, op|m.op, true
+		if !self {
+			path = filepath.Join(m.path, dir.name)
+		}
+	}
+	if m, ok := w.handles[fid.handle]; ok && fid.typ != 0 {
+		path, op, found = m.path, op|m.op, true
+	}
+	if len(w.fsMarks) == 0 || dir.typ == 0 {
+		return path, op, found
+	}
+
+	var (
+		abs      string
+		resolved bool
+	)
+	for _, m := range w.fsMarks {
+		if m.fsid != dir.fsid {
+			continue
+		}
+		if !resolved {
+			abs, resolved = w.dirPath(dir)
+			if !resolved {
+				break
+			}
+			if !self {
+				abs = filepath.Join(abs, dir.name)
+			}
+		}
+		switch {
+		case !m.recurse:
+			op |= m.op
+			if !found {
+				path, found = abs, true
+			}
+		case hasPathPrefix(abs, m.abs):
+			op |= m.op
+			if !found {
+				path, found = m.path+abs[len(m.abs):], true
+			}
+		}
+	}
+	return path, op, found
+}
+
+// Get the path for a directory handle with open_by_handle_at(). This requires
+// CAP_DAC_READ_SEARCH, and it won't work for directories that no longer exist,
+// in which case the last known path is used.
+func (w *fanotify) dirPath(dir fanInfo) (string, bool) {
+	for _, m := range w.fsMarks {
+		if m.fsid != dir.fsid {
+			continue
+		}
+
+		fd, err := unix.OpenByHandleAt(m.fd, unix.NewFileHandle(dir.htype, dir.hbytes), unix.O_PATH|unix.O_CLOEXEC)
+		if err != nil {
+			break
+		}
+		path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+		unix.Close(fd)
+		if err != nil || strings.HasSuffix(path, " (deleted)") {
+			break
+		}
+		if len(w.resolved) > 4096 {
+			clear(w.resolved)
+		}
+		w.resolved[dir.handle] = path
+		return path, true
+	}
+	path, ok := w.resolved[dir.handle]
+	return path, ok
+}
+
+// Update the last known paths for a directory rename, so that events for
+// directories that are removed after the rename get the correct path.
+func (w *fanotify) renameResolved(old, new fanInfo) {
+	if len(w.resolved) == 0 {
+		return
+	}
+	oldDir, ok := w.dirPath(old)
+	if !ok {
+		return
+	}
+	newDir, ok := w.dirPath(new)
+	if !ok {
+		return
+	}
+	from, to := filepath.Join(oldDir, old.name), filepath.Join(newDir, new.name)
+	for h, p := range w.resolved {
+		if hasPathPrefix(p, from) {
+			w.resolved[h] = to + p[len(from):]
+		}
+	}
+}
+
+// Convert the mask to events; fanotify merges events for the same file if they
+// haven't been read yet, so this can be more than one event.
+func fanotifyEvents(evs []Event, name string, mask uint64, op Op) []Event {
+	var create, other, rename, remove Op
+	if mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+		create |= Create
+	}
+	if mask&unix.FAN_OPEN != 0 {
+		other |= UnportableOpen
+	}
+	if mask&unix.FAN_ACCESS != 0 {
+		other |= UnportableRead
+	}
+	if mask&unix.FAN_MODIFY != 0 {
+		other |= Write
+	}
+	if mask&unix.FAN_ATTRIB != 0 {
+		other |= Chmod
+	}
+	if mask&unix.FAN_CLOSE_WRITE != 0 {
+		other |= UnportableCloseWrite
+	}
+	if mask&unix.FAN_CLOSE_NOWRITE != 0 {
+		other |= UnportableCloseRead
+	}
+	if mask&(unix.FAN_MOVED_FROM|unix.FAN_MOVE_SELF) != 0 {
+		rename |= Rename
+	}
+	if mask&(unix.FAN_DELETE|unix.FAN_DELETE_SELF) != 0 {
+		remove |= Remove
+	}
+
+	isDir := mask&unix.FAN_ONDIR != 0
+	for _, o := range []Op{create, other, rename, remove} {
+		if o&op != 0 {
+			evs = append(evs, Event{Name: name, Op: o & op, IsDir: isDir})
+		}
+	}
+	return evs
+}
@@ -0,0 +1,11 @@
+//go:build !linux || appengine
+
+package fsnotify
+
+import "fmt"
+
+func newFanotifyBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
+	return nil, fmt.Errorf("%w: fanotify is only available on Linux", ErrUnsupported)
+}
+
+func isFanotify(b backend) bool { return false }
@@ -0,0 +1,210 @@
+//go:build linux
+
+// Note: do not add a test here unless the behaviour is truly specific to this
+// backend. fsnotify is a cross-platform library: most tests should be as a
+// "script" in testdata/ or in fsnotify_test.go. See CONTRIBUTING.md.
+
+package fsnotify
+
+import (
+	"errors"
+	"testing"
+)
+
+func newFanotifyCollector(t *testing.T) *eventCollector {
+	t.Helper()
+	w, err := NewWatcherWith(WithFanotify())
+	if err != nil {
+		t.Skipf("fanotify not supported: %s", err)
+	}
+	return &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+}
+
+// Skip if we can't add filesystem marks; this needs CAP_SYS_ADMIN.
+func addFanotifyFS(t *testing.T, w *Watcher, path string, opts ...addOpt) {
+	t.Helper()
+	err := w.AddWith(path, opts...)
+	if err != nil {
+		w.Close()
+		t.Skipf("can't add filesystem mark: %s", err)
+	}
+}
+
+// RenamedFrom is only set on Linux 5.17 and newer.
+func cmpFanotify(t *testing.T, w *eventCollector, tmp string, want Events) {
+	t.Helper()
+	have := w.stop(t)
+	if w.w.b.(*fanotify).noRename {
+		for i := range have {
+			have[i].RenamedFrom = ""
+		}
+		for i := range want {
+			want[i].RenamedFrom = ""
+		}
+	}
+	cmpEvents(t, tmp, have, want)
+}
+
+func TestFanotify(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+
+	w := newFanotifyCollector(t)
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "file")
+	echoAppend(t, "data", tmp, "file")
+	chmod(t, 0o600, tmp, "file")
+	mv(t, join(tmp, "file"), tmp, "rename")
+	rm(t, tmp, "rename")
+	touch(t, tmp, "dir", "file") // Not recursive.
+	rmAll(t, tmp, "dir")
+
+	cmpFanotify(t, w, tmp, newEvents(t, `
+		create  /file
+		write   /file
+		chmod   /file
+		rename  /file
+		create  /rename  ←  /file
+		remove  /rename
+		remove  /dir
+	`))
+}
+
+func TestFanotifyRemoveWatched(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	touch(t, tmp, "file")
+
+	w := newFanotifyCollector(t)
+	addWatch(t, w.w, tmp, "dir")
+	addWatch(t, w.w, tmp, "file")
+	w.collect(t)
+
+	mv(t, join(tmp, "file"), tmp, "rename")
+	rmAll(t, tmp, "dir")
+	touch(t, tmp, "rename")
+	eventSeparator()
+
+	if l := w.w.WatchList(); len(l) != 0 {
+		t.Errorf("WatchList not empty: %q", l)
+	}
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		rename  /file
+		remove  /dir
+	`))
+}
+
+func TestFanotifyRecursive(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp   = t.TempDir()
+		other = t.TempDir()
+	)
+	mkdir(t, tmp, "dir")
+
+	w := newFanotifyCollector(t)
+	addFanotifyFS(t, w.w, join(tmp, "..."))
+	w.collect(t)
+
+	mkdirAll(t, tmp, "dir", "one", "two")
+	touch(t, tmp, "dir", "one", "two", "file")
+	touch(t, other, "file") // Not in the watched directory.
+	mv(t, join(tmp, "dir", "one"), tmp, "one")
+	rmAll(t, tmp, "one")
+
+	cmpFanotify(t, w, tmp, newEvents(t, `
+		create  /dir/one
+		create  /dir/one/two
+		create  /dir/one/two/file
+		rename  /dir/one
+		create  /one  ←  /dir/one
+		remove  /one/two/file
+		remove  /one/two
+		remove  /one
+	`))
+}
+
+func TestFanotifyMarks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("filesystem", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newFanotifyCollector(t)
+		addFanotifyFS(t, w.w, tmp, WithFilesystemMark(), WithOps(Create))
+		w.collect(t)
+
+		touch(t, tmp, "file")
+		mkdirAll(t, tmp, "dir", "sub")
+
+		// Will have events for the entire filesystem, so filter out ours.
+		have := w.stop(t)
+		var ours Events
+		for _, e := range have {
+			if hasPathPrefix(e.Name, tmp) {
+				ours = append(ours, e)
+			}
+		}
+		cmpEvents(t, tmp, ours, newEvents(t, `
+			create  /file
+			create  /dir
+			create  /dir/sub
+		`))
+	})
+
+	t.Run("mount", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newFanotifyCollector(t)
+		addFanotifyFS(t, w.w, tmp, WithMountMark())
+		w.collect(t)
+
+		touch(t, tmp, "new")
+		echoAppend(t, "data", tmp, "file")
+
+		have := w.stop(t)
+		var ours Events
+		for _, e := range have {
+			if hasPathPrefix(e.Name, tmp) {
+				ours = append(ours, e)
+			}
+		}
+		cmpEvents(t, tmp, ours, newEvents(t, `
+			write  /file
+		`))
+	})
+
+	t.Run("recursive mount", func(t *testing.T) {
+		t.Parallel()
+
+		w := newFanotifyCollector(t)
+		defer w.w.Close()
+		err := w.w.AddWith(join(t.TempDir(), "..."), WithMountMark())
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("not fanotify", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		for _, o := range []addOpt{WithMountMark(), WithFilesystemMark()} {
+			err := w.AddWith(t.TempDir(), o)
+			if !errors.Is(err, ErrUnsupported) {
+				t.Errorf("wrong error: %v", err)
+			}
+		}
+	})
+}
@@ -32,9 +32,9 @@ type fen struct {
 
 var defaultBufferSize = 0
 
-func newBackend(ev chan Event, errs chan error) (backend, error) {
+func newBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
 	w := &fen{
-		shared:  newShared(ev, errs),
+		shared:  newShared(ev, errs, seq),
 		Events:  ev,
 		Errors:  errs,
 		dirs:    make(map[string]Op),
@@ -64,14 +64,16 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 	if w.isClosed() {
 		return ErrClosed
 	}
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
-			time.Now().Format("15:04:05.000000000"), name)
+	if w.log.enabled() {
+		w.log.watch("AddWith", name)
 	}
 
 	with := getOptions(opts...)
-	if !w.xSupports(with.op) {
-		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	if !w.Supports(with.op) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(name); recurse {
+		return fmt.Errorf("%w: recursive watches", ErrUnsupported)
 	}
 
 	// Currently we resolve symlinks that were explicitly requested to be
@@ -80,6 +82,18 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 	if err != nil {
 		return err
 	}
+	w.mu.Lock()
+	_, dirOk := w.dirs[name]
+	_, fileOk := w.watches[name]
+	n := len(w.dirs) + len(w.watches)
+	w.mu.Unlock()
+	if !dirOk && !fileOk {
+		if err := checkMaxWatches(n, w.maxWatches); err != nil {
+			return err
+		}
+	}
+	op := w.filters.ops(filepath.Clean(name), with)
+	w.filters.set(filepath.Clean(name), false, newPathFilter(with), with)
 
 	// Associate all files in the directory.
 	if stat.IsDir() {
@@ -89,7 +103,7 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 		}
 
 		w.mu.Lock()
-		w.dirs[name] = with.op
+		w.dirs[name] = op
 		w.mu.Unlock()
 		return nil
 	}
@@ -100,11 +114,28 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 	}
 
 	w.mu.Lock()
-	w.watches[name] = with.op
+	w.watches[name] = op
 	w.mu.Unlock()
 	return nil
 }
 
+// Send the event, filtering out operations not set with WithOps().
+func (w *fen) sendEvent(e Event) bool {
+	w.mu.Lock()
+	op, ok := w.watches[e.Name]
+	if !ok {
+		op, ok = w.dirs[e.Name]
+	}
+	if !ok {
+		op, ok = w.dirs[filepath.Dir(e.Name)]
+	}
+	w.mu.Unlock()
+	if ok {
+		e.Op &= op
+	}
+	return w.shared.sendEvent(e)
+}
+
 func (w *fen) Remove(name string) error {
 	if w.isClosed() {
 		return nil
@@ -112,9 +143,8 @@ func (w *fen) Remove(name string) error {
 	if !w.port.PathIsWatched(name) {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
 	}
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
-			time.Now().Format("15:04:05.000000000"), name)
+	if w.log.enabled() {
+		w.log.watch("Remove", name)
 	}
 
 	// The user has expressed an intent. Immediately remove this name from
@@ -124,6 +154,7 @@ func (w *fen) Remove(name string) error {
 	delete(w.watches, name)
 	delete(w.dirs, name)
 	w.mu.Unlock()
+	w.filters.remove(name)
 
 	stat, err := os.Stat(name)
 	if err != nil {
@@ -176,6 +207,7 @@ func (w *fen) readEvents() {
 			}
 		}
 
+		read := time.Now()
 		p := pevents[:count]
 		for _, pevent := range p {
 			if pevent.Source != unix.PORT_SOURCE_FILE {
@@ -186,11 +218,12 @@ func (w *fen) readEvents() {
 				continue
 			}
 
-			if debug {
-				internal.Debug(pevent.Path, pevent.Events)
+			w.stats.read.Add(1)
+			if w.log.enabled() {
+				w.log.event(internal.Debug(pevent.Path, pevent.Events), pevent.Path, internal.FenMask(pevent.Events), uint64(pevent.Events), 0)
 			}
 
-			err = w.handleEvent(&pevent)
+			err = w.handleEvent(&pevent, read)
 			if !w.sendError(err) {
 				return
 			}
@@ -224,13 +257,17 @@ func (w *fen) handleDirectory(path string, stat os.FileInfo, follow bool, handle
 // bitmap matches more than one event type (e.g. the file was both modified and
 // had the attributes changed between when the association was created and the
 // when event was returned)
-func (w *fen) handleEvent(event *unix.PortEvent) error {
+func (w *fen) handleEvent(event *unix.PortEvent, read time.Time) error {
 	var (
 		events     = event.Events
 		path       = event.Path
 		fmode      = event.Cookie.(os.FileMode)
+		isDir      = fmode.IsDir()
 		reRegister = true
 	)
+	send := func(op Op) bool {
+		return w.sendEvent(Event{Name: path, Op: op, IsDir: isDir, Time: read})
+	}
 
 	w.mu.Lock()
 	_, watchedDir := w.dirs[path]
@@ -239,13 +276,13 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 	isWatched := watchedDir || watchedPath
 
 	if events&unix.FILE_DELETE != 0 {
-		if !w.sendEvent(Event{Name: path, Op: Remove}) {
+		if !send(Remove) {
 			return nil
 		}
 		reRegister = false
 	}
 	if events&unix.FILE_RENAME_FROM != 0 {
-		if !w.sendEvent(Event{Name: path, Op: Rename}) {
+		if !send(Rename) {
 			return nil
 		}
 		// Don't keep watching the new file name
@@ -259,7 +296,7 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 
 		// inotify reports a Remove event in this case, so we simulate this
 		// here.
-		if !w.sendEvent(Event{Name: path, Op: Remove}) {
+		if !send(Remove) {
 			return nil
 		}
 		// Don't keep watching the file that was removed
@@ -293,7 +330,7 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 		// get here, the sudirectory is already gone. Clearly we were watching
 		// this path but now it is gone. Let's tell the user that it was
 		// removed.
-		if !w.sendEvent(Event{Name: path, Op: Remove}) {
+		if !send(Remove) {
 			return nil
 		}
 		// Suppress extra write events on removed directories; they are not
@@ -308,7 +345,7 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 		if err != nil {
 			// The symlink still exists, but the target is gone. Report the
 			// Remove similar to above.
-			if !w.sendEvent(Event{Name: path, Op: Remove}) {
+			if !send(Remove) {
 				return nil
 			}
 			// Don't return the error
@@ -316,12 +353,12 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 	}
 
 	if events&unix.FILE_MODIFIED != 0 {
-		if fmode.IsDir() && watchedDir {
+		if isDir && watchedDir {
 			if err := w.updateDirectory(path); err != nil {
 				return err
 			}
 		} else {
-			if !w.sendEvent(Event{Name: path, Op: Write}) {
+			if !send(Write) {
 				return nil
 			}
 		}
@@ -329,7 +366,7 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 	if events&unix.FILE_ATTRIB != 0 && stat != nil {
 		// Only send Chmod if perms changed
 		if stat.Mode().Perm() != fmode.Perm() {
-			if !w.sendEvent(Event{Name: path, Op: Chmod}) {
+			if !send(Chmod) {
 				return nil
 			}
 		}
@@ -343,7 +380,7 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 			// Path may have been removed since the stat.
 			err = nil
 		}
-		return err
+		return watchError("add", path, err)
 	}
 	return nil
 }
@@ -359,7 +396,7 @@ func (w *fen) updateDirectory(path string) error {
 		if errors.Is(err, fs.ErrNotExist) {
 			return nil
 		}
-		return err
+		return watchError("read", path, err)
 	}
 
 	for _, entry := range files {
@@ -370,7 +407,7 @@ func (w *fen) updateDirectory(path string) error {
 
 		finfo, err := entry.Info()
 		if err != nil {
-			return err
+			return watchError("read", path, err)
 		}
 		err = w.associateFile(path, finfo, false)
 		if errors.Is(err, fs.ErrNotExist) {
@@ -378,10 +415,10 @@ func (w *fen) updateDirectory(path string) error {
 			// adding the port: that's okay to ignore.
 			continue
 		}
-		if !w.sendError(err) {
+		if !w.sendError(watchError("add", path, err)) {
 			return nil
 		}
-		if !w.sendEvent(Event{Name: path, Op: Create}) {
+		if !w.sendEvent(Event{Name: path, Op: Create, IsDir: entry.IsDir()}) {
 			return nil
 		}
 	}
@@ -417,7 +454,7 @@ func (w *fen) associateFile(path string, stat os.FileInfo, follow bool) error {
 		// is explicitly watched.
 		events |= unix.FILE_NOFOLLOW
 	}
-	if true { // TODO: implement withOps()
+	if true { // TODO: implement WithOps()
 		events |= unix.FILE_MODIFIED
 	}
 	if true {
@@ -441,6 +478,12 @@ func (w *fen) dissociateFile(path string, stat os.FileInfo, unused bool) error {
 	return nil
 }
 
+func (w *fen) watchCount() (total, user int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.dirs) + len(w.watches), len(w.dirs) + len(w.watches)
+}
+
 func (w *fen) WatchList() []string {
 	if w.isClosed() {
 		return nil
@@ -460,9 +503,10 @@ func (w *fen) WatchList() []string {
 	return entries
 }
 
-func (w *fen) xSupports(op Op) bool {
-	if op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
-		op.Has(xUnportableCloseWrite) || op.Has(xUnportableCloseRead) {
+func (w *fen) Supports(op Op) bool {
+	if op.Has(UnportableOpen) || op.Has(UnportableRead) ||
+		op.Has(UnportableCloseWrite) || op.Has(UnportableCloseRead) ||
+		op.Has(UnportableUnwatch) || op.Has(UnportableUnmount) {
 		return false
 	}
 	return true
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +32,11 @@ type inotify struct {
 	watches     *watches
 	doneResp    chan struct{} // Channel to respond to Close
 
+	// Symlinks added with WithSymlinks(true) are watched with IN_DONT_FOLLOW
+	// as well as the target, to see if they're replaced or removed: link wd →
+	// link.
+	links map[uint32]linkWatch
+
 	// Store rename cookies in an array, with the index wrapping to 0. Almost
 	// all of the time what we get is a MOVED_FROM to set the cookie and the
 	// next event inotify sends will be MOVED_TO to read it. However, this is
@@ -59,15 +66,23 @@ type (
 		flags      uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
 		path       string // Watch path.
 		watchFlags watchFlag
+		isDir      bool // Events for the path itself don't have IN_ISDIR.
+		moved      bool // Seen in IN_MOVED_FROM, and the path wasn't updated yet.
 	}
 	koekje struct {
 		cookie uint32
 		path   string
 	}
+	linkWatch struct {
+		path    string
+		flags   uint32 // inotify flags for the target.
+		recurse bool
+	}
 )
 
 func (w watch) byUser() bool  { return w.watchFlags&flagByUser != 0 }
 func (w watch) recurse() bool { return w.watchFlags&flagRecurse != 0 }
+func (w watch) follow() bool  { return w.watchFlags&flagFollow != 0 }
 
 func newWatches() *watches {
 	return &watches{
@@ -137,43 +152,122 @@ func (w *watches) updatePath(path string, f func(*watch) (*watch, error)) error
 
 var defaultBufferSize = 0
 
-func newBackend(ev chan Event, errs chan error) (backend, error) {
+func newBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
 	// Need to set nonblocking mode for SetDeadline to work, otherwise blocking
 	// I/O operations won't terminate on close.
 	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
 	if fd == -1 {
-		return nil, fmt.Errorf("fsnotify: initializing inotify: %w", errno)
+		return nil, fmt.Errorf("fsnotify: initializing inotify: %w", inotifyLimitError(errno))
 	}
 
 	w := &inotify{
-		shared:      newShared(ev, errs),
+		shared:      newShared(ev, errs, seq),
 		Events:      ev,
 		Errors:      errs,
 		fd:          fd,
 		inotifyFile: os.NewFile(uintptr(fd), ""),
 		watches:     newWatches(),
 		doneResp:    make(chan struct{}),
+		links:       make(map[uint32]linkWatch),
 	}
 
 	go w.readEvents()
 	return w, nil
 }
 
+func isInotify(b backend) bool {
+	_, ok := b.(*inotify)
+	return ok
+}
+
+// SystemLimits gets the inotify limits from /proc/sys/fs/inotify.
+func SystemLimits() (Limits, error) {
+	var (
+		l   Limits
+		err error
+	)
+	for _, v := range []struct {
+		name string
+		n    *int
+	}{
+		{"max_user_watches", &l.MaxUserWatches},
+		{"max_user_instances", &l.MaxUserInstances},
+		{"max_queued_events", &l.MaxQueuedEvents},
+	} {
+		*v.n, err = readSysctl("inotify." + v.name)
+		if err != nil {
+			return Limits{}, err
+		}
+	}
+	return l, nil
+}
+
+// Read an integer sysctl from /proc/sys/fs, e.g. "inotify.max_user_watches".
+func readSysctl(name string) (int, error) {
+	b, err := os.ReadFile("/proc/sys/fs/" + strings.ReplaceAll(name, ".", "/"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func inotifyLimitError(err error) error {
+	return limitError(err, "inotify.max_user_watches", "inotify.max_user_instances")
+}
+
+// Wrap ENOSPC in ErrWatchLimit and EMFILE in ErrInstanceLimit, naming the
+// sysctl for the limit. Other errors are returned as-is.
+func limitError(err error, watches, instances string) error {
+	var (
+		sentinel error
+		name     string
+	)
+	switch {
+	case errors.Is(err, unix.ENOSPC):
+		sentinel, name = ErrWatchLimit, watches
+	case errors.Is(err, unix.EMFILE):
+		// Can also be RLIMIT_NOFILE, but there's no way to tell.
+		sentinel, name = ErrInstanceLimit, instances
+	default:
+		return err
+	}
+	if n, rerr := readSysctl(name); rerr == nil {
+		return fmt.Errorf("%w: fs.%s=%d: %w", sentinel, name, n, err)
+	}
+	return fmt.Errorf("%w: fs.%s: %w", sentinel, name, err)
+}
+
+func (w *inotify) watchCount() (total, user int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ww := range w.watches.wd {
+		if ww.byUser() {
+			user++
+		}
+	}
+	return w.watches.len() + len(w.links), user
+}
+
 func (w *inotify) Close() error {
 	if w.shared.close() {
 		return nil
 	}
 
 	// Causes any blocking reads to return with an error, provided the file
-	// still supports deadline operations.
+	// still supports deadline operations. This is done with the lock held, so
+	// that nothing uses the fd after it's closed: the fd number may be reused
+	// by another Watcher right away.
+	w.mu.Lock()
 	err := w.inotifyFile.Close()
 	if err != nil {
+		w.mu.Unlock()
 		return err
 	}
-	w.mu.Lock()
+	// Closing the inotify fd removes all the watches.
 	for name := range w.watches.path {
-		w.remove(name)
+		_, _ = w.watches.removePath(name)
 	}
+	clear(w.links)
 	w.mu.Unlock()
 
 	<-w.doneResp // Wait for readEvents() to finish.
@@ -186,96 +280,226 @@ func (w *inotify) AddWith(path string, opts ...addOpt) error {
 	if w.isClosed() {
 		return ErrClosed
 	}
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
-			time.Now().Format("15:04:05.000000000"), path)
+	if w.log.enabled() {
+		w.log.watch("AddWith", path)
 	}
 
 	with := getOptions(opts...)
-	if !w.xSupports(with.op) {
-		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
-	}
-
-	add := func(path string, with withOpts, wf watchFlag) error {
-		var flags uint32
-		if with.op.Has(Create) {
-			flags |= unix.IN_CREATE
-		}
-		if with.op.Has(Write) {
-			flags |= unix.IN_MODIFY
-		}
-		if with.op.Has(Remove) {
-			flags |= unix.IN_DELETE | unix.IN_DELETE_SELF
-		}
-		if with.op.Has(Rename) {
-			flags |= unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_MOVE_SELF
-		}
-		if with.op.Has(Chmod) {
-			flags |= unix.IN_ATTRIB
-		}
-		if with.op.Has(xUnportableOpen) {
-			flags |= unix.IN_OPEN
-		}
-		if with.op.Has(xUnportableRead) {
-			flags |= unix.IN_ACCESS
-		}
-		if with.op.Has(xUnportableCloseWrite) {
-			flags |= unix.IN_CLOSE_WRITE
-		}
-		if with.op.Has(xUnportableCloseRead) {
-			flags |= unix.IN_CLOSE_NOWRITE
-		}
-		return w.register(path, flags, wf)
+	if !w.Supports(with.op) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, with.op)
 	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	path, recurse := recursivePath(path)
+	flags := inotifyFlags(w.filters.ops(path, with))
+	stat, wf := os.Stat, watchFlag(0)
+	switch with.symlinks {
+	case symlinkFollow:
+		wf = flagFollow
+	case symlinkNoFollow:
+		flags |= unix.IN_DONT_FOLLOW
+		stat = os.Lstat
+	}
+	if hasFilter(with) || w.filters.isParent(path) {
+		w.filters.set(path, recurse, newPathFilter(with), with)
+	} else {
+		w.filters.remove(path) // From an earlier AddWith() with a filter.
+	}
+	var err error
 	if recurse {
-		return filepath.WalkDir(path, func(root string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if !d.IsDir() {
-				if root == path {
-					return fmt.Errorf("fsnotify: not a directory: %q", path)
-				}
+		_, err = w.addRecurse(path, flags, wf|flagByUser, false, nil)
+	} else {
+		fi, statErr := stat(path)
+		err = w.register(path, flags, wf|flagByUser, statErr == nil && fi.IsDir())
+	}
+	if err == nil && wf&flagFollow != 0 {
+		err = w.watchLink(path, flags, recurse)
+		if err != nil {
+			w.remove(path)
+		}
+	}
+	if err != nil {
+		w.filters.remove(path)
+		return err
+	}
+	if w.queueExisting(path, recurse, with) {
+		// Wake up readEvents() to send them.
+		_ = w.inotifyFile.SetReadDeadline(time.Now())
+	}
+	return nil
+}
+
+// Watch the symlink itself for WithSymlinks(true), so that we can see if it's
+// replaced or removed. Does nothing if path isn't a symlink.
+//
+// Must be called with w.mu held.
+func (w *inotify) watchLink(path string, flags uint32, recurse bool) error {
+	if w.isClosed() { // The fd may be closed.
+		return ErrClosed
+	}
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	if err := checkMaxWatches(w.watches.len()+len(w.links), w.maxWatches); err != nil {
+		return err
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, path,
+		unix.IN_DONT_FOLLOW|unix.IN_MASK_ADD|unix.IN_DELETE_SELF|unix.IN_MOVE_SELF)
+	if wd == -1 {
+		return inotifyLimitError(err)
+	}
+	w.links[uint32(wd)] = linkWatch{path: path, flags: flags, recurse: recurse}
+	return nil
+}
+
+// Stop watching the symlink for path, if any.
+//
+// Must be called with w.mu held.
+func (w *inotify) unwatchLink(path string) {
+	if w.isClosed() { // The fd may be closed.
+		return
+	}
+	for wd, l := range w.links {
+		if l.path == path {
+			delete(w.links, wd)
+			_, _ = unix.InotifyRmWatch(w.fd, wd)
+		}
+	}
+}
+
+// Get the inotify flags for the operations.
+func inotifyFlags(op Op) uint32 {
+	var flags uint32
+	if op.Has(Create) {
+		flags |= unix.IN_CREATE
+	}
+	if op.Has(Write) {
+		flags |= unix.IN_MODIFY
+	}
+	if op.Has(Remove) {
+		flags |= unix.IN_DELETE | unix.IN_DELETE_SELF
+	}
+	if op.Has(Rename) {
+		flags |= unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_MOVE_SELF
+	}
+	if op.Has(Chmod) {
+		flags |= unix.IN_ATTRIB
+	}
+	if op.Has(UnportableOpen) {
+		flags |= unix.IN_OPEN
+	}
+	if op.Has(UnportableRead) {
+		flags |= unix.IN_ACCESS
+	}
+	if op.Has(UnportableCloseWrite) {
+		flags |= unix.IN_CLOSE_WRITE
+	}
+	if op.Has(UnportableCloseRead) {
+		flags |= unix.IN_CLOSE_NOWRITE
+	}
+	// Always sent by the kernel; only used to see if we should send them.
+	if op.Has(UnportableUnwatch) {
+		flags |= unix.IN_IGNORED
+	}
+	if op.Has(UnportableUnmount) {
+		flags |= unix.IN_UNMOUNT
+	}
+	return flags
+}
+
+// Add a recursive watch for root and all directories below it.
+//
+// If sendCreate is set a Create event is added to evs for every path below root.
+// This is for "mkdir -p one/two/three": usually all those directories will be
+// created before we can set up watchers on the subdirectories, so only "one"
+// would be sent as a Create event and not "one/two" and "one/two/three"
+// (inotifywait -r has the same problem). Files are included for the same
+// reason: "mkdir one && touch one/file" can create the file before the watch is
+// set up.
+//
+// Symlinks to directories are followed if wf has flagFollow; directories that
+// are already watched through another path aren't watched again.
+//
+// Must be called with w.mu held.
+func (w *inotify) addRecurse(root string, flags uint32, wf watchFlag, sendCreate bool, evs []Event) ([]Event, error) {
+	var (
+		byUser = wf&flagByUser != 0
+		follow = wf&flagFollow != 0
+		walk   = filepath.WalkDir
+	)
+	if follow {
+		walk = walkFollow
+	}
+	err := walk(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while we were walking the tree; not an error, as we'll
+			// get a Remove event for it.
+			if !byUser && errors.Is(err, fs.ErrNotExist) {
 				return nil
 			}
-
-			// Send a Create event when adding new directory from a recursive
-			// watch; this is for "mkdir -p one/two/three". Usually all those
-			// directories will be created before we can set up watchers on the
-			// subdirectories, so only "one" would be sent as a Create event and
-			// not "one/two" and "one/two/three" (inotifywait -r has the same
-			// problem).
-			if with.sendCreate && root != path {
-				w.sendEvent(Event{Name: root, Op: Create})
+			return err
+		}
+		// Don't watch excluded directories at all.
+		if (path != root || !byUser) && w.filters.excluded(path, d.IsDir) {
+			if d.IsDir() {
+				return filepath.SkipDir
 			}
-
-			wf := flagRecurse
-			if root == path {
-				wf |= flagByUser
+			return nil
+		}
+		if sendCreate && path != root {
+			evs = append(evs, Event{Name: path, Op: Create, IsDir: d.IsDir()})
+		}
+		if !d.IsDir() {
+			if path == root {
+				return fmt.Errorf("fsnotify: not a directory: %q", path)
 			}
-			return add(root, with, wf)
-		})
-	}
+			return nil
+		}
 
-	return add(path, with, 0)
+		f := flagRecurse | wf&flagFollow
+		if byUser && path == root {
+			f |= flagByUser
+		}
+		err = w.register(path, flags, f, true)
+		if !byUser && errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		if _, ok := w.watches.path[path]; err == nil && follow && !ok {
+			return filepath.SkipDir // Already watched through another path.
+		}
+		return err
+	})
+	return evs, err
 }
 
-func (w *inotify) register(path string, flags uint32, wf watchFlag) error {
+func (w *inotify) register(path string, flags uint32, wf watchFlag, isDir bool) error {
+	if w.isClosed() { // The fd may be closed.
+		return ErrClosed
+	}
 	return w.watches.updatePath(path, func(existing *watch) (*watch, error) {
 		if existing != nil {
 			flags |= existing.flags | unix.IN_MASK_ADD
+		} else if err := checkMaxWatches(w.watches.len()+len(w.links), w.maxWatches); err != nil {
+			return nil, err
 		}
 
 		wd, err := unix.InotifyAddWatch(w.fd, path, flags)
 		if wd == -1 {
-			return nil, err
+			return nil, inotifyLimitError(err)
+		}
+		if w.log.enabled() {
+			w.log.watch("inotify_add_watch", path, slog.Int("wd", wd), slog.String("mask", internal.InotifyMask(flags)))
 		}
 
 		if e, ok := w.watches.wd[uint32(wd)]; ok {
+			// Already watched with another path: the directory was renamed,
+			// or it's reached through a symlink. Use the new path if the old
+			// one no longer refers to it.
+			if e.path != path && !sameFile(e.path, path) {
+				delete(w.watches.path, e.path)
+				e.path, e.moved = path, false
+			}
 			return e, nil
 		}
 
@@ -285,6 +509,7 @@ func (w *inotify) register(path string, flags uint32, wf watchFlag) error {
 				path:       path,
 				flags:      flags,
 				watchFlags: wf,
+				isDir:      isDir,
 			}, nil
 		}
 
@@ -298,23 +523,34 @@ func (w *inotify) Remove(name string) error {
 	if w.isClosed() {
 		return nil
 	}
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
-			time.Now().Format("15:04:05.000000000"), name)
+	if w.log.enabled() {
+		w.log.watch("Remove", name)
 	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.remove(filepath.Clean(name))
+	err := w.remove(filepath.Clean(name))
+	if err == nil {
+		w.filters.remove(name)
+		path, _ := recursivePath(name)
+		w.unwatchLink(path)
+	}
+	return err
 }
 
 func (w *inotify) remove(name string) error {
+	if w.isClosed() { // The fd may be closed.
+		return nil
+	}
 	wds, err := w.watches.removePath(name)
 	if err != nil {
 		return err
 	}
 
 	for _, wd := range wds {
+		if w.log.enabled() {
+			w.log.watch("inotify_rm_watch", name, slog.Uint64("wd", uint64(wd)))
+		}
 		_, err := unix.InotifyRmWatch(w.fd, wd)
 		if err != nil {
 			// TODO: Perhaps it's not helpful to return an error here in every
@@ -342,8 +578,15 @@ func (w *inotify) WatchList() []string {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	entries := make([]string, 0, w.watches.len())
-	for pathname := range w.watches.path {
-		entries = append(entries, pathname)
+	for _, watch := range w.watches.wd {
+		switch {
+		case watch.recurse() && !watch.byUser():
+			continue
+		case watch.recurse():
+			entries = append(entries, filepath.Join(watch.path, "..."))
+		default:
+			entries = append(entries, watch.path)
+		}
 	}
 	return entries
 }
@@ -357,13 +600,26 @@ func (w *inotify) readEvents() {
 		close(w.Events)
 	}()
 
-	var buf [unix.SizeofInotifyEvent * 4096]byte // Buffer for a maximum of 4096 raw events
+	var (
+		buf [unix.SizeofInotifyEvent * 4096]byte // Buffer for a maximum of 4096 raw events
+		evs = make([]Event, 0, 8)                // Events to send for a single inotify event.
+	)
 	for {
 		if w.isClosed() {
 			return
 		}
 
 		n, err := w.inotifyFile.Read(buf[:])
+		wakeup := errors.Is(err, os.ErrDeadlineExceeded) // Woken up by AddWith() for WithExisting().
+		if wakeup {
+			_ = w.inotifyFile.SetReadDeadline(time.Time{})
+		}
+		if !w.sendExisting() {
+			return
+		}
+		if wakeup {
+			continue
+		}
 		if err != nil {
 			if errors.Is(err, os.ErrClosed) {
 				return
@@ -373,9 +629,11 @@ func (w *inotify) readEvents() {
 			}
 			continue
 		}
+		read := time.Now()
+		w.stats.bytes.Add(uint64(n))
 
 		if n < unix.SizeofInotifyEvent {
-			err := errors.New("notify: short read in readEvents()") // Read was too short.
+			err := errors.New("fsnotify: short read in readEvents()") // Read was too short.
 			if n == 0 {
 				err = io.EOF // If EOF is received. This should really never happen.
 			}
@@ -391,6 +649,7 @@ func (w *inotify) readEvents() {
 		for offset <= uint32(n-unix.SizeofInotifyEvent) {
 			// Point to the event in the buffer.
 			inEvent := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			w.stats.read.Add(1)
 
 			if inEvent.Mask&unix.IN_Q_OVERFLOW != 0 {
 				if !w.sendError(ErrEventOverflow) {
@@ -398,12 +657,16 @@ func (w *inotify) readEvents() {
 				}
 			}
 
-			ev, ok := w.handleEvent(inEvent, &buf, offset)
+			var ok bool
+			evs, ok = w.handleEvent(inEvent, &buf, offset, evs[:0])
 			if !ok {
 				return
 			}
-			if !w.sendEvent(ev) {
-				return
+			for _, ev := range evs {
+				ev.Time = read
+				if !w.sendEvent(ev) {
+					return
+				}
 			}
 
 			// Move to the next event in the buffer
@@ -412,7 +675,9 @@ func (w *inotify) readEvents() {
 	}
 }
 
-func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offset uint32) (Event, bool) {
+// handleEvent converts the inotify event to zero or more Events, which are
+// appended to evs. Returns false if the watcher was closed.
+func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offset uint32, evs []Event) ([]Event, bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -424,9 +689,12 @@ func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offs
 	/// Can be nil if Remove() was called in another goroutine for this path
 	/// inbetween reading the events from the kernel and reading the internal
 	/// state. Not much we can do about it, so just skip. See #616.
+	if l, ok := w.links[uint32(inEvent.Wd)]; ok {
+		return w.handleLink(uint32(inEvent.Wd), l, inEvent.Mask, evs)
+	}
 	watch := w.watches.byWd(uint32(inEvent.Wd))
 	if watch == nil {
-		return Event{}, true
+		return evs, true
 	}
 
 	var (
@@ -437,13 +705,28 @@ func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offs
 		name += "/" + inotifyEventName(buf, offset, nameLen)
 	}
 
-	if debug {
-		internal.Debug(name, inEvent.Mask, inEvent.Cookie)
+	if w.log.enabled() {
+		w.log.event(internal.Debug(name, inEvent.Mask, inEvent.Cookie), name, internal.InotifyMask(inEvent.Mask), uint64(inEvent.Mask), inEvent.Cookie)
 	}
 
+	// The watch is still there if the kernel removed it without us seeing a
+	// Remove or Rename for it: the filesystem was unmounted, or the path was
+	// removed when IN_DELETE_SELF isn't in the mask.
 	if inEvent.Mask&unix.IN_IGNORED != 0 || inEvent.Mask&unix.IN_UNMOUNT != 0 {
 		w.watches.remove(watch)
-		return Event{}, true
+		if inEvent.Mask&unix.IN_UNMOUNT != 0 {
+			return append(evs, unwatchEvent(watch, UnportableUnmount)), true
+		}
+		if watch.byUser() {
+			return append(evs, unwatchEvent(watch, 0)), true
+		}
+		return evs, true
+	}
+	// Send UnportableUnwatch after the Remove or Rename event if the watch for
+	// a path added by the user is removed.
+	var unwatch []Event
+	if watch.byUser() && inEvent.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+		unwatch = append(unwatch, unwatchEvent(watch, 0))
 	}
 
 	// inotify will automatically remove the watch on deletes; just need
@@ -455,21 +738,32 @@ func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offs
 	// We can't really update the state when a watched path is moved; only
 	// IN_MOVE_SELF is sent and not IN_MOVED_{FROM,TO}. So remove the watch.
 	if inEvent.Mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
-		// Watch is set up as part of recurse: do nothing as the move gets
-		// registered from the parent directory.
+		// Watch is set up as part of recurse: the move gets registered from
+		// the parent directory with IN_MOVED_TO. If the path wasn't updated
+		// it was moved out of the watched tree, so remove the watches for it
+		// and everything below it.
 		if watch.recurse() && !watch.byUser() {
-			return Event{}, true
+			if watch.moved {
+				err := w.remove(filepath.Join(watch.path, "..."))
+				if err != nil && !errors.Is(err, ErrNonExistentWatch) {
+					if !w.sendError(watchError("remove", watch.path, err)) {
+						return evs, false
+					}
+				}
+			}
+			return evs, true
 		}
 
 		err := w.remove(watch.path)
 		if err != nil && !errors.Is(err, ErrNonExistentWatch) {
-			if !w.sendError(err) {
-				return Event{}, false
+			if !w.sendError(watchError("remove", watch.path, err)) {
+				return evs, false
 			}
 		}
 
 		if watch.recurse() {
-			return Event{Name: watch.path, Op: Rename}, true
+			evs = append(evs, Event{Name: watch.path, Op: Rename, IsDir: true})
+			return append(evs, unwatch...), true
 		}
 	}
 
@@ -478,37 +772,73 @@ func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offs
 	if inEvent.Mask&unix.IN_DELETE_SELF != 0 {
 		_, ok := w.watches.path[filepath.Dir(watch.path)]
 		if ok {
-			return Event{}, true
+			return append(evs, unwatch...), true
 		}
 	}
 
 	ev := w.newEvent(name, inEvent.Mask, inEvent.Cookie)
+	ev.IsDir = inEvent.Mask&unix.IN_ISDIR != 0 || (nameLen == 0 && watch.isDir)
+	evs = append(evs, ev)
+	evs = append(evs, unwatch...)
 	// Need to update watch path for recurse.
 	if watch.recurse() {
-		isDir := inEvent.Mask&unix.IN_ISDIR == unix.IN_ISDIR
-		/// New directory created: set up watch on it.
-		if isDir && ev.Has(Create) {
-			err := w.register(ev.Name, watch.flags, flagRecurse)
-			if !w.sendError(err) {
-				return Event{}, false
+		if ev.IsDir && inEvent.Mask&unix.IN_MOVED_FROM != 0 {
+			if moved := w.watches.byPath(ev.Name); moved != nil && !moved.byUser() {
+				moved.moved = true
+			}
+		}
+
+		// Symlinks to directories are watched as directories: remove the
+		// watches for the old target if the link is replaced or removed, and
+		// add watches for the new target.
+		if watch.follow() && !ev.IsDir && ev.Has(Create|Remove|Rename) {
+			for _, p := range []string{ev.Name, ev.RenamedFrom} {
+				if _, ok := w.watches.path[p]; ok {
+					if !w.sendError(watchError("remove", p, w.remove(p))) {
+						return evs, false
+					}
+				}
+			}
+			if ev.Has(Create) && isDirLink(ev.Name) {
+				var err error
+				evs, err = w.addRecurse(ev.Name, watch.flags, flagFollow, true, evs)
+				if !w.sendError(watchError("add", ev.Name, err)) {
+					return evs, false
+				}
 			}
+			return evs, true
+		}
 
+		/// New directory created: set up watch on it.
+		if ev.IsDir && ev.Has(Create) {
 			// Directory rename, so we need to update all the children.
 			//
 			// TODO: this is of course pretty slow; we should use a better data
 			// structure for storing all of this, e.g. store children in the
 			// watch. I have some code for this in my kqueue refactor we can use
-			// in the future. For now I'm okay with this as it's not publicly
-			// available. Correctness first, performance second.
-			if ev.renamedFrom != "" {
+			// in the future. Correctness first, performance second.
+			_, watched := w.watches.path[ev.RenamedFrom]
+			if watched && w.filters.excluded(ev.Name, func() bool { return true }) {
+				// Renamed to an excluded name: stop watching it.
+				err := w.remove(ev.RenamedFrom)
+				if !w.sendError(watchError("remove", ev.RenamedFrom, err)) {
+					return evs, false
+				}
+				return evs, true
+			}
+			if watched {
+				err := w.register(ev.Name, watch.flags, flagRecurse, true)
+				if !w.sendError(watchError("add", ev.Name, err)) {
+					return evs, false
+				}
 				for path, wd := range w.watches.path {
 					if wd == watch.wd || path == ev.Name {
 						continue
 					}
 
-					if hasPathPrefix(path, ev.renamedFrom) {
+					if hasPathPrefix(path, ev.RenamedFrom) {
 						delete(w.watches.path, path)
-						path = strings.Replace(path, ev.renamedFrom, ev.Name, 1)
+						path = strings.Replace(path, ev.RenamedFrom, ev.Name, 1)
 						w.watches.path[path] = wd
 
 						ww := w.watches.wd[wd]
@@ -516,11 +846,161 @@ func (w *inotify) handleEvent(inEvent *unix.InotifyEvent, buf *[65536]byte, offs
 						w.watches.wd[wd] = ww
 					}
 				}
+				return evs, true
+			}
+
+			// New directory, or moved in from outside the watched tree: set
+			// up watches for it and all subdirectories.
+			var err error
+			evs, err = w.addRecurse(ev.Name, watch.flags, watch.watchFlags&flagFollow, true, evs)
+			if !w.sendError(watchError("add", ev.Name, err)) {
+				return evs, false
+			}
+		}
+	}
+
+	return evs, true
+}
+
+// The symlink for a path added with WithSymlinks(true) was replaced or
+// removed: watch the new target, or remove the watch if it's gone.
+//
+// Must be called with w.mu held.
+func (w *inotify) handleLink(wd uint32, l linkWatch, mask uint32, evs []Event) ([]Event, bool) {
+	if mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) == 0 {
+		return evs, true
+	}
+	delete(w.links, wd)
+	if mask&unix.IN_MOVE_SELF != 0 && !w.isClosed() {
+		_, _ = unix.InotifyRmWatch(w.fd, wd) // Still valid after a move.
+	}
+
+	// The old target is still watched with the path of the link.
+	err := w.remove(l.path)
+	if err != nil && !errors.Is(err, ErrNonExistentWatch) {
+		if !w.sendError(watchError("remove", l.path, err)) {
+			return evs, false
+		}
+	}
+
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		w.filters.remove(l.path)
+		switch {
+		case mask&unix.IN_MOVE_SELF != 0 && l.flags&unix.IN_MOVE_SELF != 0:
+			evs = append(evs, Event{Name: l.path, Op: Rename})
+		case mask&unix.IN_DELETE_SELF != 0 && l.flags&unix.IN_DELETE_SELF != 0:
+			evs = append(evs, Event{Name: l.path, Op: Remove})
+		}
+		return evs, true
+	}
+
+	if l.recurse {
+		evs, err = w.addRecurse(l.path, l.flags, flagByUser|flagFollow, false, evs)
+	} else {
+		err = w.register(l.path, l.flags, flagFollow|flagByUser, fi.IsDir())
+	}
+	if err == nil {
+		err = w.watchLink(l.path, l.flags, l.recurse)
+	}
+	if err != nil {
+		return evs, w.sendError(watchError("add", l.path, err))
+	}
+	if l.flags&unix.IN_CREATE != 0 {
+		evs = append(evs, Event{Name: l.path, Op: Create, IsDir: fi.IsDir()})
+	}
+	return evs, true
+}
+
+// Walk the tree like filepath.WalkDir, but follow symlinks. Directories that
+// were already seen aren't walked again, so this is safe with symlink loops.
+func walkFollow(root string, fn fs.WalkDirFunc) error {
+	type fileID struct{ dev, ino uint64 }
+	seen := make(map[fileID]struct{})
+
+	var walk func(path string, d fs.DirEntry) error
+	walk = func(path string, d fs.DirEntry) error {
+		if d.Type()&fs.ModeSymlink != 0 {
+			if fi, err := os.Stat(path); err == nil {
+				d = fs.FileInfoToDirEntry(fi)
+			}
+		}
+		if !d.IsDir() {
+			return fn(path, d, nil)
+		}
+		if fi, err := d.Info(); err == nil {
+			dev, ino := fileInode(fi)
+			if _, ok := seen[fileID{dev, ino}]; ok {
+				return nil
+			}
+			seen[fileID{dev, ino}] = struct{}{}
+		}
+
+		err := fn(path, d, nil)
+		if err != nil {
+			if err == filepath.SkipDir {
+				return nil
 			}
+			return err
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			err = fn(path, d, err)
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
 		}
+		for _, e := range entries {
+			err := walk(filepath.Join(path, e.Name()), e)
+			if err == filepath.SkipDir { // Skip the rest of the directory.
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	return ev, true
+	fi, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return walk(root, fs.FileInfoToDirEntry(fi))
+}
+
+// Report if path is a symlink to a directory.
+func isDirLink(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		return false
+	}
+	fi, err = os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Report if both paths exist and refer to the same file.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// Get the UnportableUnwatch event for a watch that was removed by the kernel,
+// with the operations that are in the watch's mask.
+func unwatchEvent(watch *watch, op Op) Event {
+	op |= UnportableUnwatch
+	if watch.flags&unix.IN_IGNORED == 0 {
+		op &^= UnportableUnwatch
+	}
+	if watch.flags&unix.IN_UNMOUNT == 0 {
+		op &^= UnportableUnmount
+	}
+	return Event{Name: watch.path, Op: op, IsDir: watch.isDir}
 }
 
 func inotifyEventName(buf *[65536]byte, offset, nameLen uint32) string {
@@ -544,16 +1024,16 @@ func (w *inotify) newEvent(name string, mask, cookie uint32) Event {
 		e.Op |= Write
 	}
 	if mask&unix.IN_OPEN == unix.IN_OPEN {
-		e.Op |= xUnportableOpen
+		e.Op |= UnportableOpen
 	}
 	if mask&unix.IN_ACCESS == unix.IN_ACCESS {
-		e.Op |= xUnportableRead
+		e.Op |= UnportableRead
 	}
 	if mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
-		e.Op |= xUnportableCloseWrite
+		e.Op |= UnportableCloseWrite
 	}
 	if mask&unix.IN_CLOSE_NOWRITE == unix.IN_CLOSE_NOWRITE {
-		e.Op |= xUnportableCloseRead
+		e.Op |= UnportableCloseRead
 	}
 	if mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF || mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
 		e.Op |= Rename
@@ -581,13 +1061,13 @@ func (w *inotify) newEvent(name string, mask, cookie uint32) Event {
 				}
 			}
 			w.cookiesMu.Unlock()
-			e.renamedFrom = prev
+			e.RenamedFrom = prev
 		}
 	}
 	return e
 }
 
-func (w *inotify) xSupports(op Op) bool {
+func (w *inotify) Supports(op Op) bool {
 	return true // Supports everything.
 }
 
@@ -0,0 +1,11 @@
+//go:build !linux || appengine
+
+package fsnotify
+
+func isInotify(b backend) bool { return false }
+
+// SystemLimits gets the inotify limits from /proc/sys/fs/inotify; this always
+// returns ErrUnsupported on platforms other than Linux.
+func SystemLimits() (Limits, error) {
+	return Limits{}, ErrUnsupported
+}
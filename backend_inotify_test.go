@@ -9,11 +9,14 @@ package fsnotify
 import (
 	"errors"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -151,3 +154,240 @@ func TestInotifyDeleteOpenFile(t *testing.T) {
 	e = w.stop(t)
 	cmpEvents(t, tmp, e, newEvents(t, `remove /file`))
 }
+
+// Excluded directories shouldn't use a watch.
+func TestInotifyExcludeWatches(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opt  addOpt
+	}{
+		{"exclude", WithExclude("node_modules")},
+		{"gitignore", WithGitignore()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp, other := t.TempDir(), t.TempDir()
+			mkdirAll(t, tmp, "node_modules", "pkg", "sub")
+			mkdirAll(t, tmp, ".git", "objects")
+			mkdir(t, tmp, "src")
+			echoTrunc(t, "node_modules/", tmp, ".gitignore")
+
+			w := newWatcher(t)
+			defer w.Close()
+			if err := w.AddWith(join(tmp, "..."), tt.opt, WithExclude(".git")); err != nil {
+				t.Fatal(err)
+			}
+			mkdirAll(t, tmp, "src", "node_modules", "pkg")
+			mkdirAll(t, other, "sub")
+			mv(t, join(other, "sub"), tmp, "src", "node_modules", "sub")
+			eventSeparator()
+
+			var have []string
+			w.b.(*inotify).mu.Lock()
+			for p := range w.b.(*inotify).watches.path {
+				have = append(have, strings.TrimPrefix(p, tmp))
+			}
+			w.b.(*inotify).mu.Unlock()
+			slices.Sort(have)
+			if want := []string{"", "/src"}; !slices.Equal(have, want) {
+				t.Errorf("\nhave: %q\nwant: %q", have, want)
+			}
+		})
+	}
+}
+
+func TestInotifySymlinks(t *testing.T) {
+	t.Parallel()
+
+	// Get the events as "OP path", with path relative to tmp.
+	events := func(t *testing.T, w *eventCollector, tmp string) []string {
+		t.Helper()
+		eventSeparator()
+		var have []string
+		for _, e := range w.events(t) {
+			have = append(have, e.Op.String()+" "+strings.TrimPrefix(e.Name, tmp+"/"))
+		}
+		return have
+	}
+	check := func(t *testing.T, have []string, want ...string) {
+		t.Helper()
+		if !slices.Equal(have, want) {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+	}
+
+	t.Run("no follow", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		symlink(t, join(tmp, "file"), tmp, "link")
+
+		w := newCollector(t)
+		w.collect(t)
+		if err := w.w.AddWith(join(tmp, "link"), WithSymlinks(false)); err != nil {
+			t.Fatal(err)
+		}
+
+		echoAppend(t, "data", tmp, "file")
+		check(t, events(t, w, tmp))
+		rm(t, tmp, "link") // unlink always emits a chmod on Linux.
+		check(t, events(t, w, tmp), "CHMOD link", "REMOVE link")
+		w.stop(t)
+	})
+
+	t.Run("follow replaced link", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir1")
+		mkdir(t, tmp, "dir2")
+		symlink(t, join(tmp, "dir1"), tmp, "link")
+
+		w := newCollector(t)
+		w.collect(t)
+		if err := w.w.AddWith(join(tmp, "link"), WithSymlinks(true)); err != nil {
+			t.Fatal(err)
+		}
+
+		touch(t, tmp, "dir1", "a")
+		check(t, events(t, w, tmp), "CREATE link/a")
+
+		// ln -sfn
+		symlink(t, join(tmp, "dir2"), tmp, "link.tmp")
+		mv(t, join(tmp, "link.tmp"), tmp, "link")
+		check(t, events(t, w, tmp), "CREATE link")
+
+		touch(t, tmp, "dir1", "c")
+		touch(t, tmp, "dir2", "b")
+		check(t, events(t, w, tmp), "CREATE link/b")
+		w.stop(t)
+	})
+
+	t.Run("follow recursive with loop", func(t *testing.T) {
+		t.Parallel()
+
+		tmp, other := t.TempDir(), t.TempDir()
+		mkdir(t, tmp, "sub")
+		symlink(t, tmp, tmp, "sub", "loop")
+		symlink(t, other, tmp, "ext")
+
+		w := newCollector(t)
+		w.collect(t)
+		if err := w.w.AddWith(join(tmp, "..."), WithSymlinks(true)); err != nil {
+			t.Fatal(err)
+		}
+
+		touch(t, other, "x")
+		check(t, events(t, w, tmp), "CREATE ext/x")
+		w.stop(t)
+	})
+
+	t.Run("polling", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		err := w.AddWith(t.TempDir(), WithSymlinks(true), WithPolling(time.Second))
+		if !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestInotifyLimits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("system", func(t *testing.T) {
+		l, err := SystemLimits()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.MaxUserWatches == 0 || l.MaxUserInstances == 0 || l.MaxQueuedEvents == 0 {
+			t.Errorf("%+v", l)
+		}
+
+		err = inotifyLimitError(unix.ENOSPC)
+		if !errors.Is(err, ErrWatchLimit) || !errors.Is(err, unix.ENOSPC) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if want := "fs.inotify.max_user_watches=" + strconv.Itoa(l.MaxUserWatches); !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't contain %q", err, want)
+		}
+		err = inotifyLimitError(unix.EMFILE)
+		if !errors.Is(err, ErrInstanceLimit) || !errors.Is(err, unix.EMFILE) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	// New subdirectories in a recursive watch send the error on the Errors
+	// channel.
+	t.Run("recursive", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "sub")
+		w, err := NewWatcherWith(WithMaxWatches(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp, "...")
+		if n := w.WatchCount(); n != 2 {
+			t.Errorf("WatchCount: %d", n)
+		}
+
+		mkdir(t, tmp, "new")
+		for {
+			select {
+			case <-w.Events:
+				continue
+			case err := <-w.Errors:
+				if !errors.Is(err, ErrWatchLimit) {
+					t.Fatalf("wrong error: %v", err)
+				}
+				var werr *WatchError
+				if !errors.As(err, &werr) || werr.Op != "add" || werr.Path != join(tmp, "new") {
+					t.Errorf("not a WatchError for the new directory: %#v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no error")
+			}
+			break
+		}
+		if n := w.WatchCount(); n != 2 {
+			t.Errorf("WatchCount: %d", n)
+		}
+	})
+}
+
+func TestInotifyUnmount(t *testing.T) {
+	tmp := t.TempDir()
+	if err := unix.Mount("fsnotify", tmp, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount tmpfs: %s", err)
+	}
+	mkdir(t, tmp, "dir")
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddWith(join(tmp, "dir"), WithOps(Create|UnportableUnwatch|UnportableUnmount)); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Unmount(tmp, 0); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	if l := w.w.WatchList(); len(l) != 0 {
+		t.Errorf("still in WatchList: %q", l)
+	}
+
+	have := w.stop(t)
+	want := Events{{Name: join(tmp, "dir"), Op: UnportableUnwatch | UnportableUnmount}}
+	if len(have) != 1 || have[0].Name != want[0].Name || have[0].Op != want[0].Op {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
@@ -33,7 +33,7 @@ type (
 		path   map[string]int              // pathname → wd
 		byDir  map[string]map[int]struct{} // dirname(path) → wd
 		seen   map[string]struct{}         // Keep track of if we know this file exists.
-		byUser map[string]struct{}         // Watches added with Watcher.Add()
+		byUser map[string]Op               // Watches added with Watcher.Add(), and the ops to send.
 	}
 	watch struct {
 		wd       int
@@ -50,7 +50,7 @@ func newWatches() *watches {
 		path:   make(map[string]int),
 		byDir:  make(map[string]map[int]struct{}),
 		seen:   make(map[string]struct{}),
-		byUser: make(map[string]struct{}),
+		byUser: make(map[string]Op),
 	}
 }
 
@@ -88,10 +88,25 @@ func (w *watches) watchesInDir(path string) []string {
 }
 
 // Mark path as added by the user.
-func (w *watches) addUserWatch(path string) {
+func (w *watches) addUserWatch(path string, op Op) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	w.byUser[path] = struct{}{}
+	w.byUser[path] = op
+}
+
+// Get the operations to send for path; this is the operations for the path
+// itself if it was added by the user, or the operations of the parent
+// directory.
+func (w *watches) ops(path string) Op {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if op, ok := w.byUser[path]; ok {
+		return op
+	}
+	if op, ok := w.byUser[filepath.Dir(path)]; ok {
+		return op
+	}
+	return defaultOpts.op
 }
 
 func (w *watches) addLink(path string, fd int) {
@@ -118,6 +133,13 @@ func (w *watches) add(path, linkPath string, fd int, isDir bool) {
 	byDir[fd] = struct{}{}
 }
 
+// Get the number of watches, and the number of watches added by the user.
+func (w *watches) len() (int, int) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.wd), len(w.byUser)
+}
+
 func (w *watches) byWd(fd int) (watch, bool) {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
@@ -185,14 +207,14 @@ func (w *watches) seenBefore(path string) bool {
 
 var defaultBufferSize = 0
 
-func newBackend(ev chan Event, errs chan error) (backend, error) {
+func newBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
 	kq, closepipe, err := newKqueue()
 	if err != nil {
 		return nil, err
 	}
 
 	w := &kqueue{
-		shared:    newShared(ev, errs),
+		shared:    newShared(ev, errs, seq),
 		Events:    ev,
 		Errors:    errs,
 		kq:        kq,
@@ -257,30 +279,44 @@ func (w *kqueue) Close() error {
 func (w *kqueue) Add(name string) error { return w.AddWith(name) }
 
 func (w *kqueue) AddWith(name string, opts ...addOpt) error {
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
-			time.Now().Format("15:04:05.000000000"), name)
+	if w.log.enabled() {
+		w.log.watch("AddWith", name)
 	}
 
 	with := getOptions(opts...)
-	if !w.xSupports(with.op) {
-		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	if !w.Supports(with.op) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(name); recurse {
+		return fmt.Errorf("%w: recursive watches", ErrUnsupported)
 	}
 
+	op := w.filters.ops(filepath.Clean(name), with)
+	w.filters.set(filepath.Clean(name), false, newPathFilter(with), with)
 	_, err := w.addWatch(name, noteAllEvents, false)
 	if err != nil {
+		w.filters.remove(name)
 		return err
 	}
-	w.watches.addUserWatch(name)
+	w.watches.addUserWatch(name, op)
 	return nil
 }
 
+// Send the event, filtering out operations not set with WithOps().
+func (w *kqueue) sendEvent(e Event) bool {
+	e.Op &= w.watches.ops(e.Name)
+	return w.shared.sendEvent(e)
+}
+
 func (w *kqueue) Remove(name string) error {
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
-			time.Now().Format("15:04:05.000000000"), name)
+	if w.log.enabled() {
+		w.log.watch("Remove", name)
+	}
+	err := w.remove(name, true)
+	if err == nil {
+		w.filters.remove(name)
 	}
-	return w.remove(name, true)
+	return err
 }
 
 func (w *kqueue) remove(name string, unwatchFiles bool) error {
@@ -319,6 +355,8 @@ func (w *kqueue) remove2(name string, unwatchFiles bool) error {
 	return nil
 }
 
+func (w *kqueue) watchCount() (total, user int) { return w.watches.len() }
+
 func (w *kqueue) WatchList() []string {
 	if w.isClosed() {
 		return nil
@@ -379,9 +417,16 @@ func (w *kqueue) addWatch(name string, flags uint32, listDir bool) (string, erro
 			}
 		}
 
+		n, _ := w.watches.len()
+		if err := checkMaxWatches(n, w.maxWatches); err != nil {
+			return "", err
+		}
 		info.wd, err = internal.IgnoringEINTR(func() (int, error) {
 			return unix.Open(name, openMode, 0)
 		})
+		if errors.Is(err, unix.EMFILE) || errors.Is(err, unix.ENFILE) {
+			return "", fmt.Errorf("%w: maximum number of open files: %w", ErrWatchLimit, err)
+		}
 		if err != nil {
 			return "", err
 		}
@@ -440,6 +485,7 @@ func (w *kqueue) readEvents() {
 				return
 			}
 		}
+		read := time.Now()
 
 		for _, kevent := range kevents {
 			var (
@@ -454,8 +500,9 @@ func (w *kqueue) readEvents() {
 			}
 
 			path, ok := w.watches.byWd(wd)
-			if debug {
-				internal.Debug(path.name, &kevent)
+			w.stats.read.Add(1)
+			if w.log.enabled() {
+				w.log.event(internal.Debug(path.name, uint32(kevent.Fflags)), path.name, internal.KqueueMask(uint32(kevent.Fflags)), uint64(kevent.Fflags), 0)
 			}
 
 			// On macOS it seems that sometimes an event with Ident=0 is
@@ -481,6 +528,7 @@ func (w *kqueue) readEvents() {
 			}
 
 			event := w.newEvent(path.name, path.linkName, mask)
+			event.IsDir, event.Time = path.isDir, read
 
 			if event.Has(Rename) || event.Has(Remove) {
 				w.remove(event.Name, false)
@@ -488,7 +536,9 @@ func (w *kqueue) readEvents() {
 			}
 
 			if path.isDir && event.Has(Write) && !event.Has(Remove) {
-				w.dirChange(event.Name)
+				if !w.sendError(w.dirChange(event.Name)) {
+					return
+				}
 			} else if !w.sendEvent(event) {
 				return
 			}
@@ -524,7 +574,7 @@ func (w *kqueue) readEvents() {
 					path := filepath.Clean(event.Name)
 					if fi, err := os.Lstat(path); err == nil {
 						err := w.sendCreateIfNew(path, fi)
-						if !w.sendError(err) {
+						if !w.sendError(watchError("add", path, err)) {
 							return
 						}
 					}
@@ -573,6 +623,12 @@ func (w *kqueue) watchDirectoryFiles(dirPath string) error {
 	for _, f := range files {
 		path := filepath.Join(dirPath, f.Name())
 
+		// Don't need to open a file descriptor for excluded paths.
+		if w.filters.excluded(path, f.IsDir) {
+			w.watches.markSeen(path, true)
+			continue
+		}
+
 		fi, err := f.Info()
 		if err != nil {
 			return fmt.Errorf("%q: %w", path, err)
@@ -610,25 +666,26 @@ func (w *kqueue) dirChange(dir string) error {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil
 		}
-		return fmt.Errorf("fsnotify.dirChange %q: %w", dir, err)
+		return watchError("read", dir, err)
 	}
 
 	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
 		fi, err := f.Info()
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
 				return nil
 			}
-			return fmt.Errorf("fsnotify.dirChange: %w", err)
+			return watchError("read", path, err)
 		}
 
-		err = w.sendCreateIfNew(filepath.Join(dir, fi.Name()), fi)
+		err = w.sendCreateIfNew(path, fi)
 		if err != nil {
 			// Don't need to send an error if this file isn't readable.
 			if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) || errors.Is(err, os.ErrNotExist) {
 				return nil
 			}
-			return fmt.Errorf("fsnotify.dirChange: %w", err)
+			return watchError("add", path, err)
 		}
 	}
 	return nil
@@ -637,8 +694,12 @@ func (w *kqueue) dirChange(dir string) error {
 // Send a create event if the file isn't already being tracked, and start
 // watching this file.
 func (w *kqueue) sendCreateIfNew(path string, fi os.FileInfo) error {
+	if w.filters.excluded(path, fi.IsDir) {
+		w.watches.markSeen(path, true)
+		return nil
+	}
 	if !w.watches.seenBefore(path) {
-		if !w.sendEvent(Event{Name: path, Op: Create}) {
+		if !w.sendEvent(Event{Name: path, Op: Create, IsDir: fi.IsDir()}) {
 			return nil
 		}
 	}
@@ -690,12 +751,13 @@ func (w *kqueue) read(events []unix.Kevent_t) ([]unix.Kevent_t, error) {
 	return events[0:n], nil
 }
 
-func (w *kqueue) xSupports(op Op) bool {
+func (w *kqueue) Supports(op Op) bool {
 	//if runtime.GOOS == "freebsd" {
 	//	return true // Supports everything.
 	//}
-	if op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
-		op.Has(xUnportableCloseWrite) || op.Has(xUnportableCloseRead) {
+	if op.Has(UnportableOpen) || op.Has(UnportableRead) ||
+		op.Has(UnportableCloseWrite) || op.Has(UnportableCloseRead) ||
+		op.Has(UnportableUnwatch) || op.Has(UnportableUnmount) {
 		return false
 	}
 	return true
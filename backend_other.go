@@ -2,21 +2,9 @@
 
 package fsnotify
 
-import "errors"
-
-type other struct {
-	Events chan Event
-	Errors chan error
-}
-
 var defaultBufferSize = 0
 
-func newBackend(ev chan Event, errs chan error) (backend, error) {
-	return nil, errors.New("fsnotify not supported on the current platform")
+// There is no native backend for this platform, so always use polling.
+func newBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
+	return newPollingBackend(ev, errs, seq, 0, true), nil
 }
-func (w *other) Close() error                              { return nil }
-func (w *other) WatchList() []string                       { return nil }
-func (w *other) Add(name string) error                     { return nil }
-func (w *other) AddWith(name string, opts ...addOpt) error { return nil }
-func (w *other) Remove(name string) error                  { return nil }
-func (w *other) xSupports(op Op) bool                      { return false }
@@ -0,0 +1,278 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// The default polling interval, if it's not set with [WithPolling] or
+// [WithPollingBackend].
+const defaultPollInterval = time.Second
+
+// polling is a backend that periodically scans the watched paths with
+// os.Lstat() and os.ReadDir(), and compares it with the previous scan.
+//
+// It works on any filesystem, including network filesystems, but it's a lot
+// less efficient than the native backends and may miss changes that happen in
+// between two scans (e.g. a file that's created and then removed again).
+type polling struct {
+	*shared
+	Events chan Event
+	Errors chan error
+
+	interval   time.Duration // Default interval for Add().
+	watches    map[string]*pollWatch
+	wakeup     chan struct{} // Re-schedule after adding a watch.
+	doneResp   chan struct{} // Channel to respond to Close
+	closeChans bool          // Close Events and Errors on Close.
+}
+
+type pollWatch struct {
+	path     string
+	recurse  bool
+	op       Op
+	interval time.Duration
+	next     time.Time
+	snap     snapshot
+	filter   *pathFilter
+}
+
+func newPollingBackend(ev chan Event, errs chan error, seq *sequence, interval time.Duration, closeChans bool) *polling {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	w := &polling{
+		shared:     newShared(ev, errs, seq),
+		Events:     ev,
+		Errors:     errs,
+		interval:   interval,
+		watches:    make(map[string]*pollWatch),
+		wakeup:     make(chan struct{}, 1),
+		doneResp:   make(chan struct{}),
+		closeChans: closeChans,
+	}
+	go w.readEvents()
+	return w
+}
+
+func (w *polling) Close() error {
+	if w.shared.close() {
+		return nil
+	}
+	<-w.doneResp // Wait for readEvents() to finish.
+	return nil
+}
+
+func (w *polling) Add(name string) error { return w.AddWith(name) }
+
+func (w *polling) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if w.log.enabled() {
+		w.log.watch("AddWith", path)
+	}
+
+	with := getOptions(opts...)
+	if !w.Supports(with.op) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, with.op)
+	}
+	if with.pollInterval <= 0 {
+		with.pollInterval = w.interval
+	}
+
+	path, recurse := recursivePath(path)
+	filter := newPathFilter(with)
+	snap, err := takeSnapshot(path, recurse, filter.skipFunc(path))
+	if err != nil {
+		return err
+	}
+	if recurse && !snap[path].isDir() {
+		return fmt.Errorf("fsnotify: not a directory: %q", path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	op := w.filters.ops(path, with)
+	if watch, ok := w.watches[path]; ok {
+		// Already watched as a parent directory for WithNonExistent() or
+		// WithFollowName(), or the other way around.
+		if with.parent != nil || w.filters.isParent(path) {
+			watch.op |= op
+			w.filters.set(path, recurse, filter, with)
+		}
+		return nil
+	}
+	w.watches[path] = &pollWatch{
+		path:     path,
+		recurse:  recurse,
+		op:       op,
+		interval: with.pollInterval,
+		next:     time.Now().Add(with.pollInterval),
+		snap:     snap,
+		filter:   filter,
+	}
+	w.filters.set(path, recurse, filter, with)
+	w.existing = append(w.existing, existingEvents(path, snap, with)...)
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *polling) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if w.log.enabled() {
+		w.log.watch("Remove", name)
+	}
+
+	path, recurse := recursivePath(name)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch, ok := w.watches[path]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, path)
+	}
+	if recurse && !watch.recurse {
+		return fmt.Errorf("can't use /... with non-recursive watch %q", path)
+	}
+	delete(w.watches, path)
+	w.filters.remove(path)
+	return nil
+}
+
+func (w *polling) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for _, watch := range w.watches {
+		if watch.recurse {
+			entries = append(entries, filepath.Join(watch.path, "..."))
+		} else {
+			entries = append(entries, watch.path)
+		}
+	}
+	return entries
+}
+
+// Polling doesn't use any watches.
+func (w *polling) watchCount() (total, user int) { return 0, 0 }
+
+func (w *polling) Supports(op Op) bool {
+	return op&(UnportableOpen|UnportableRead|UnportableCloseWrite|UnportableCloseRead|
+		UnportableUnwatch|UnportableUnmount) == 0
+}
+
+// readEvents scans all watches that are due, and sends the differences with
+// the previous scan on the Events channel.
+func (w *polling) readEvents() {
+	defer func() {
+		close(w.doneResp)
+		if w.closeChans {
+			close(w.Errors)
+			close(w.Events)
+		}
+	}()
+
+	t := time.NewTimer(w.interval)
+	defer t.Stop()
+	for {
+		t.Reset(w.nextPoll())
+		select {
+		case <-w.done:
+			return
+		case <-w.wakeup:
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			if !w.sendExisting() {
+				return
+			}
+		case <-t.C:
+			if !w.poll() {
+				return
+			}
+		}
+	}
+}
+
+// Get the duration until the next watch is due.
+func (w *polling) nextPoll() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	next := w.interval
+	for _, watch := range w.watches {
+		if d := time.Until(watch.next); d < next {
+			next = d
+		}
+	}
+	return max(next, 0)
+}
+
+// Scan all watches that are due. Returns false if the watcher was closed.
+func (w *polling) poll() bool {
+	if !w.sendExisting() {
+		return false
+	}
+
+	w.mu.Lock()
+	now := time.Now()
+	due := make([]*pollWatch, 0, len(w.watches))
+	for _, watch := range w.watches {
+		if !watch.next.After(now) {
+			due = append(due, watch)
+			watch.next = now.Add(watch.interval)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, watch := range due {
+		// Scan without the lock, as this may take a while on slow filesystems.
+		snap, err := takeSnapshot(watch.path, watch.recurse, watch.filter.skipFunc(watch.path))
+		found := time.Now()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if !w.sendError(watchError("read", watch.path, err)) {
+				return false
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		if w.watches[watch.path] != watch { // Removed while we were scanning.
+			w.mu.Unlock()
+			continue
+		}
+		evs := watch.snap.diff(snap)
+		watch.snap = snap
+		if snap == nil { // Watched path is gone: remove the watch.
+			delete(w.watches, watch.path)
+			w.filters.remove(watch.path)
+		}
+		w.mu.Unlock()
+
+		for _, ev := range evs {
+			w.stats.read.Add(1)
+			if w.log.enabled() {
+				w.log.event(fmt.Sprintf("%-30s → %q", ev.Op, ev.Name), ev.Name, ev.Op.String(), uint64(ev.Op), 0)
+			}
+			ev.Op, ev.Time = ev.Op&watch.op, found
+			if !w.sendEvent(ev) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+// Note: do not add a test here unless the behaviour is truly specific to this
+// backend. fsnotify is a cross-platform library: most tests should be as a
+// "script" in testdata/ or in fsnotify_test.go. See CONTRIBUTING.md.
+
+package fsnotify
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newPollingCollector(t *testing.T) *eventCollector {
+	w, err := NewWatcherWith(WithPollingBackend(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.b.(*polling); !ok {
+		t.Fatalf("wrong backend: %T", w.b)
+	}
+	return &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+}
+
+func TestPolling(t *testing.T) {
+	pollWait := func() { time.Sleep(100 * time.Millisecond) }
+
+	tests := []struct {
+		name    string
+		recurse bool
+		setup   func(t *testing.T, tmp string)
+		do      func(t *testing.T, tmp string)
+		want    string
+	}{
+		{"create", false,
+			func(t *testing.T, tmp string) {},
+			func(t *testing.T, tmp string) {
+				touch(t, tmp, "file")
+				mkdir(t, tmp, "dir")
+				pollWait()
+				touch(t, tmp, "dir", "file") // Not recursive.
+			}, `
+				create /dir
+				create /file
+			`},
+		{"write", false,
+			func(t *testing.T, tmp string) { touch(t, tmp, "file") },
+			func(t *testing.T, tmp string) { echoAppend(t, "data", tmp, "file") }, `
+				write  /file
+			`},
+		{"remove", false,
+			func(t *testing.T, tmp string) {
+				touch(t, tmp, "file")
+				mkdir(t, tmp, "dir")
+			},
+			func(t *testing.T, tmp string) {
+				rm(t, tmp, "file")
+				rmAll(t, tmp, "dir")
+			}, `
+				remove /file
+				remove /dir
+			`},
+		{"rename", false,
+			func(t *testing.T, tmp string) { touch(t, tmp, "file") },
+			func(t *testing.T, tmp string) { mv(t, join(tmp, "file"), tmp, "rename") }, `
+				rename /file
+				create /rename ← /file
+
+				windows:
+					remove /file
+					create /rename
+			`},
+		{"rename over existing", false,
+			func(t *testing.T, tmp string) {
+				touch(t, tmp, "file")
+				echoAppend(t, "data", tmp, "file.tmp")
+			},
+			func(t *testing.T, tmp string) { mv(t, join(tmp, "file.tmp"), tmp, "file") }, `
+				rename /file.tmp
+				create /file ← /file.tmp
+
+				windows:
+					remove /file.tmp
+					write  /file
+			`},
+		{"recurse", true,
+			func(t *testing.T, tmp string) { mkdirAll(t, tmp, "a", "b") },
+			func(t *testing.T, tmp string) {
+				touch(t, tmp, "a", "b", "file")
+				mkdirAll(t, tmp, "x", "y")
+			}, `
+				create /a/b/file
+				create /x
+				create /x/y
+			`},
+		{"rename dir", true,
+			func(t *testing.T, tmp string) {
+				mkdirAll(t, tmp, "a", "b")
+				touch(t, tmp, "a", "b", "file")
+			},
+			func(t *testing.T, tmp string) { mv(t, join(tmp, "a"), tmp, "x") }, `
+				rename /a
+				create /x ← /a
+
+				windows:
+					remove /a/b/file
+					remove /a/b
+					remove /a
+					create /x
+					create /x/b
+					create /x/b/file
+			`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			tt.setup(t, tmp)
+
+			w := newPollingCollector(t)
+			path := tmp
+			if tt.recurse {
+				path = join(tmp, "...")
+			}
+			if err := w.w.Add(path); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+			tt.do(t, tmp)
+			pollWait()
+
+			cmpEvents(t, tmp, w.stop(t), newEvents(t, tt.want))
+		})
+	}
+}
+
+func TestPollingRemoveWatched(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newPollingCollector(t)
+	addWatch(t, w.w, file)
+	w.collect(t)
+
+	rm(t, file)
+	time.Sleep(100 * time.Millisecond)
+	if l := w.w.WatchList(); len(l) != 0 {
+		t.Errorf("watch not removed: %q", l)
+	}
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `remove /file`))
+}
+
+// Use polling for one path with WithPolling(), and the native backend for
+// everything else.
+func TestWithPolling(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp    = t.TempDir()
+		native = join(tmp, "native")
+		poll   = join(tmp, "poll")
+	)
+	mkdir(t, native)
+	mkdir(t, poll)
+
+	w := newCollector(t, native)
+	if err := w.w.AddWith(poll, WithPolling(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if w.w.poll == nil {
+		t.Fatal("w.poll is nil")
+	}
+
+	have := w.w.WatchList()
+	slices.Sort(have)
+	if want := []string{native, poll}; !slices.Equal(have, want) {
+		t.Errorf("WatchList()\nhave: %q\nwant: %q", have, want)
+	}
+
+	err := w.w.AddWith(poll, WithPolling(time.Second), WithOps(UnportableOpen))
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("wrong error for unportable op: %v", err)
+	}
+
+	w.collect(t)
+	touch(t, native, "file")
+	touch(t, poll, "file")
+	time.Sleep(100 * time.Millisecond)
+
+	if err := w.w.Remove(poll); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.Remove(poll); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("wrong error for removing twice: %v", err)
+	}
+	touch(t, poll, "file2")
+	time.Sleep(100 * time.Millisecond)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /native/file
+		create /poll/file
+	`))
+
+	if err := w.w.AddWith(poll, WithPolling(time.Second)); !errors.Is(err, ErrClosed) {
+		t.Errorf("wrong error after Close: %v", err)
+	}
+}
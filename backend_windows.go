@@ -24,19 +24,25 @@ import (
 type readDirChangesW struct {
 	Events chan Event
 	Errors chan error
+	seq    *sequence
+	read   time.Time // Time of the last read; only used from readEvents().
 
 	port  windows.Handle // Handle to completion port
 	input chan *input    // Inputs to the reader are sent on this channel
 	done  chan chan<- error
 
-	mu      sync.Mutex // Protects access to watches, closed
-	watches watchMap   // Map of watches (key: i-number)
-	closed  bool       // Set to true when Close() is first called
+	mu         sync.Mutex // Protects access to watches, closed
+	watches    watchMap   // Map of watches (key: i-number)
+	closed     bool       // Set to true when Close() is first called
+	filters    filterSet  // Filters set with WithInclude() and WithExclude().
+	maxWatches int        // Set with WithMaxWatches(); 0 if there is no maximum.
+	log        logger
+	stats      statCounters
 }
 
 var defaultBufferSize = 50
 
-func newBackend(ev chan Event, errs chan error) (backend, error) {
+func newBackend(ev chan Event, errs chan error, seq *sequence) (backend, error) {
 	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
 	if err != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
@@ -44,6 +50,7 @@ func newBackend(ev chan Event, errs chan error) (backend, error) {
 	w := &readDirChangesW{
 		Events:  ev,
 		Errors:  errs,
+		seq:     seq,
 		port:    port,
 		watches: make(watchMap),
 		input:   make(chan *input, 1),
@@ -65,7 +72,14 @@ func (w *readDirChangesW) sendEvent(name, renamedFrom string, mask uint64) bool
 	}
 
 	event := w.newEvent(name, uint32(mask))
-	event.renamedFrom = renamedFrom
+	event.RenamedFrom = renamedFrom
+	event.Time = w.read
+	if !w.filters.apply(&event) {
+		w.stats.filtered.Add(1)
+		return true
+	}
+	w.seq.stamp(&event)
+	w.stats.sent.Add(1) // Before sending, so that it's counted once received.
 	select {
 	case ch := <-w.done:
 		w.done <- ch
@@ -79,6 +93,8 @@ func (w *readDirChangesW) sendError(err error) bool {
 	if err == nil {
 		return true
 	}
+	w.log.error(err)
+	w.stats.error(err)
 	select {
 	case <-w.done:
 		return false
@@ -95,6 +111,7 @@ func (w *readDirChangesW) Close() error {
 	w.mu.Lock()
 	w.closed = true
 	w.mu.Unlock()
+	w.filters.close()
 
 	// Send "done" message to the reader goroutine
 	ch := make(chan error)
@@ -111,40 +128,46 @@ func (w *readDirChangesW) AddWith(name string, opts ...addOpt) error {
 	if w.isClosed() {
 		return ErrClosed
 	}
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
-			time.Now().Format("15:04:05.000000000"), filepath.ToSlash(name))
+	if w.log.enabled() {
+		w.log.watch("AddWith", filepath.ToSlash(name))
 	}
 
 	with := getOptions(opts...)
-	if !w.xSupports(with.op) {
-		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	if !w.Supports(with.op) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, with.op)
 	}
 	if with.bufsize < 4096 {
 		return fmt.Errorf("fsnotify.WithBufferSize: buffer size cannot be smaller than 4096 bytes")
 	}
 
+	path, recurse := recursivePath(name)
+	flags := windowsFlags(w.filters.ops(path, with))
+	w.filters.set(path, recurse, newPathFilter(with), with)
 	in := &input{
 		op:      opAddWatch,
 		path:    filepath.Clean(name),
-		flags:   sysFSALLEVENTS,
+		flags:   flags,
 		reply:   make(chan error),
 		bufsize: with.bufsize,
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
+		w.filters.remove(path)
 		return err
 	}
-	return <-in.reply
+	err := <-in.reply
+	if err != nil {
+		w.filters.remove(path)
+	}
+	return err
 }
 
 func (w *readDirChangesW) Remove(name string) error {
 	if w.isClosed() {
 		return nil
 	}
-	if debug {
-		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
-			time.Now().Format("15:04:05.000000000"), filepath.ToSlash(name))
+	if w.log.enabled() {
+		w.log.watch("Remove", filepath.ToSlash(name))
 	}
 
 	in := &input{
@@ -156,9 +179,28 @@ func (w *readDirChangesW) Remove(name string) error {
 	if err := w.wakeupReader(); err != nil {
 		return err
 	}
-	return <-in.reply
+	err := <-in.reply
+	if err == nil {
+		w.filters.remove(name)
+	}
+	return err
 }
 
+func (w *readDirChangesW) setOpts(opts watcherOpts) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxWatches = opts.maxWatches
+	w.log.set(opts.logger)
+}
+
+func (w *readDirChangesW) watchCount() (total, user int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watches.len(), w.watches.len()
+}
+
+func (w *readDirChangesW) counters() *statCounters { return &w.stats }
+
 func (w *readDirChangesW) WatchList() []string {
 	if w.isClosed() {
 		return nil
@@ -175,7 +217,11 @@ func (w *readDirChangesW) WatchList() []string {
 			}
 			// the directory itself is being watched
 			if watchEntry.mask != 0 {
-				entries = append(entries, watchEntry.path)
+				if watchEntry.recurse {
+					entries = append(entries, filepath.Join(watchEntry.path, "..."))
+				} else {
+					entries = append(entries, watchEntry.path)
+				}
 			}
 		}
 	}
@@ -200,8 +246,36 @@ const (
 	sysFSMOVEDTO    = 0x80
 	sysFSMOVESELF   = 0x800
 	sysFSIGNORED    = 0x8000
+
+	// Not an event; set when none of the ops can be watched, so there's
+	// still a handle for the path.
+	sysFSWATCH = 0x1000
 )
 
+// Get the sysFS* flags for the operations.
+func windowsFlags(op Op) uint32 {
+	var flags uint32
+	if op.Has(Create) {
+		flags |= sysFSCREATE | sysFSMOVEDTO
+	}
+	if op.Has(Write) {
+		flags |= sysFSMODIFY
+	}
+	if op.Has(Remove) {
+		flags |= sysFSDELETE | sysFSDELETESELF
+	}
+	if op.Has(Rename) {
+		flags |= sysFSMOVEDFROM | sysFSMOVESELF
+	}
+	// Windows doesn't have anything for Chmod; still watch the path so that
+	// Add() and WatchList() work as usual, but never send any events for
+	// it.
+	if flags == 0 {
+		flags = sysFSWATCH
+	}
+	return flags
+}
+
 func (w *readDirChangesW) newEvent(name string, mask uint32) Event {
 	e := Event{Name: name}
 	if mask&sysFSCREATE == sysFSCREATE || mask&sysFSMOVEDTO == sysFSMOVEDTO {
@@ -312,6 +386,14 @@ func (m watchMap) get(ino *inode) *watch {
 	return nil
 }
 
+func (m watchMap) len() int {
+	var n int
+	for _, i := range m {
+		n += len(i)
+	}
+	return n
+}
+
 // Must run within the I/O thread.
 func (m watchMap) set(ino *inode, watch *watch) {
 	i := m[ino.volume]
@@ -337,8 +419,13 @@ func (w *readDirChangesW) addWatch(pathname string, flags uint64, bufsize int) e
 	}
 	w.mu.Lock()
 	watchEntry := w.watches.get(ino)
+	n, maxWatches := w.watches.len(), w.maxWatches
 	w.mu.Unlock()
 	if watchEntry == nil {
+		if err := checkMaxWatches(n, maxWatches); err != nil {
+			windows.CloseHandle(ino.handle)
+			return err
+		}
 		_, err := windows.CreateIoCompletionPort(ino.handle, w.port, 0, 0)
 		if err != nil {
 			windows.CloseHandle(ino.handle)
@@ -455,7 +542,7 @@ func (w *readDirChangesW) deleteWatch(watch *watch) {
 func (w *readDirChangesW) startRead(watch *watch) error {
 	err := windows.CancelIo(watch.ino.handle)
 	if err != nil {
-		w.sendError(os.NewSyscallError("CancelIo", err))
+		w.sendError(watchError("read", watch.path, os.NewSyscallError("CancelIo", err)))
 		w.deleteWatch(watch)
 	}
 	mask := w.toWindowsFlags(watch.mask)
@@ -505,6 +592,7 @@ func (w *readDirChangesW) readEvents() {
 	for {
 		// This error is handled after the watch == nil check below.
 		qErr := windows.GetQueuedCompletionStatus(w.port, &n, &key, &ov, windows.INFINITE)
+		w.read = time.Now()
 
 		watch := (*watch)(unsafe.Pointer(ov))
 		if watch == nil {
@@ -569,6 +657,7 @@ func (w *readDirChangesW) readEvents() {
 			continue
 		}
 
+		w.stats.bytes.Add(uint64(n))
 		var offset uint32
 		for {
 			if n == 0 {
@@ -585,8 +674,9 @@ func (w *readDirChangesW) readEvents() {
 			name := windows.UTF16ToString(buf)
 			fullname := filepath.Join(watch.path, name)
 
-			if debug {
-				internal.Debug(fullname, raw.Action)
+			w.stats.read.Add(1)
+			if w.log.enabled() {
+				w.log.event(internal.Debug(fullname, raw.Action), filepath.ToSlash(fullname), internal.WindowsMask(raw.Action), uint64(raw.Action), 0)
 			}
 
 			var mask uint64
@@ -654,7 +744,7 @@ func (w *readDirChangesW) readEvents() {
 		}
 
 		if err := w.startRead(watch); err != nil {
-			w.sendError(err)
+			w.sendError(watchError("read", watch.path, err))
 		}
 	}
 }
@@ -664,7 +754,7 @@ func (w *readDirChangesW) toWindowsFlags(mask uint64) uint32 {
 	if mask&sysFSMODIFY != 0 {
 		m |= windows.FILE_NOTIFY_CHANGE_LAST_WRITE
 	}
-	if mask&(sysFSMOVE|sysFSCREATE|sysFSDELETE) != 0 {
+	if mask&(sysFSMOVE|sysFSCREATE|sysFSDELETE|sysFSWATCH) != 0 {
 		m |= windows.FILE_NOTIFY_CHANGE_FILE_NAME | windows.FILE_NOTIFY_CHANGE_DIR_NAME
 	}
 	return m
@@ -686,9 +776,10 @@ func (w *readDirChangesW) toFSnotifyFlags(action uint32) uint64 {
 	return 0
 }
 
-func (w *readDirChangesW) xSupports(op Op) bool {
-	if op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
-		op.Has(xUnportableCloseWrite) || op.Has(xUnportableCloseRead) {
+func (w *readDirChangesW) Supports(op Op) bool {
+	if op.Has(UnportableOpen) || op.Has(UnportableRead) ||
+		op.Has(UnportableCloseWrite) || op.Has(UnportableCloseRead) ||
+		op.Has(UnportableUnwatch) || op.Has(UnportableUnmount) {
 		return false
 	}
 	return true
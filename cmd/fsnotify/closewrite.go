@@ -1,6 +1,18 @@
 package main
 
-/*
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Wait until a file is no longer being written to, for example to process a
+// file once an upload has finished.
+//
+// This uses UnportableCloseWrite if the platform supports it, and falls back to
+// waiting until Write events stop (see dedup.go) if it doesn't.
 func closeWrite(paths ...string) {
 	if len(paths) < 1 {
 		exit("must specify at least one path to watch")
@@ -47,7 +59,7 @@ func closeWriteLoop(w *fsnotify.Watcher, cw bool) {
 			if !ok {
 				return
 			}
-			panic(err)
+			printTime("ERROR: %s", err)
 		case e, ok := <-w.Events:
 			if !ok {
 				return
@@ -86,4 +98,3 @@ func closeWriteLoop(w *fsnotify.Watcher, cw bool) {
 		}
 	}
 }
-*/
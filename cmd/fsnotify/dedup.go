@@ -1,8 +1,9 @@
 package main
 
 import (
-	"math"
-	"sync"
+	"context"
+	"os"
+	"os/signal"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -13,91 +14,47 @@ import (
 // the binary.
 //
 // The general strategy to deal with this is to wait a short time for more write
-// events, resetting the wait period for every new event.
+// events, resetting the wait period for every new event. WithDebounce() does
+// exactly that.
 func dedup(paths ...string) {
 	if len(paths) < 1 {
 		exit("must specify at least one path to watch")
 	}
 
-	// Create a new watcher.
-	w, err := fsnotify.NewWatcher()
+	// Create a new watcher. Wait 100ms for new events; each new event for the
+	// same path resets the timer. Send the event after at most a second, even
+	// if events keep coming in.
+	w, err := fsnotify.NewWatcherWith(fsnotify.WithDebounce(100*time.Millisecond, time.Second))
 	if err != nil {
 		exit("creating a new watcher: %s", err)
 	}
 	defer w.Close()
 
-	// Start listening for events.
-	go dedupLoop(w)
-
-	// Add all paths from the commandline.
+	// Add all paths from the commandline. We just want to watch for file
+	// creation, so ignore everything outside of Create and Write.
 	for _, p := range paths {
-		err = w.Add(p)
+		err = w.AddWith(p, fsnotify.WithOps(fsnotify.Create|fsnotify.Write))
 		if err != nil {
 			exit("%q: %s", p, err)
 		}
 	}
 
-	printTime("ready; press ^C to exit")
-	<-make(chan struct{}) // Block forever
-}
-
-func dedupLoop(w *fsnotify.Watcher) {
-	var (
-		// Wait 100ms for new events; each new event resets the timer.
-		waitFor = 100 * time.Millisecond
-
-		// Keep track of the timers, as path → timer.
-		mu     sync.Mutex
-		timers = make(map[string]*time.Timer)
-
-		// Callback we run.
-		printEvent = func(e fsnotify.Event) {
-			printTime(e.String())
-
-			// Don't need to remove the timer if you don't have a lot of files.
-			mu.Lock()
-			delete(timers, e.Name)
-			mu.Unlock()
-		}
-	)
+	// Run() reads events until the context is cancelled (here on ^C), and
+	// closes the watcher when it's done. Instead of writing our own select
+	// loop, we just handle the events and errors as they come in.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	for {
-		select {
-		// Read from Errors.
-		case err, ok := <-w.Errors:
-			if !ok { // Channel was closed (i.e. Watcher.Close() was called).
-				return
-			}
+	printTime("ready; press ^C to exit")
+	err = w.Run(ctx, func(e fsnotify.Event, err error) error {
+		if err != nil {
 			printTime("ERROR: %s", err)
-		// Read from Events.
-		case e, ok := <-w.Events:
-			if !ok { // Channel was closed (i.e. Watcher.Close() was called).
-				return
-			}
-
-			// We just want to watch for file creation, so ignore everything
-			// outside of Create and Write.
-			if !e.Has(fsnotify.Create) && !e.Has(fsnotify.Write) {
-				continue
-			}
-
-			// Get timer.
-			mu.Lock()
-			t, ok := timers[e.Name]
-			mu.Unlock()
-
-			// No timer yet, so create one.
-			if !ok {
-				t = time.AfterFunc(math.MaxInt64, func() { printEvent(e) })
-				t.Stop()
-
-				mu.Lock()
-				timers[e.Name] = t
-				mu.Unlock()
-			}
-
-			// Reset the timer for this path, so it will start from 100ms again.
-			t.Reset(waitFor)
+			return nil
 		}
+		printTime(e.String())
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		exit("%s", err)
 	}
 }
@@ -19,6 +19,8 @@ Commands:
     watch [paths]  Watch the paths for changes and print the events.
     file  [file]   Watch a single file for changes.
     dedup [paths]  Watch the paths for changes, suppressing duplicate events.
+    closewrite [paths]
+                   Print paths once they're closed after writing.
 `[1:]
 
 func exit(format string, a ...any) {
@@ -61,5 +63,7 @@ func main() {
 		file(args...)
 	case "dedup":
 		dedup(args...)
+	case "closewrite":
+		closeWrite(args...)
 	}
 }
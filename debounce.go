@@ -0,0 +1,91 @@
+package fsnotify
+
+import (
+	"sort"
+	"time"
+)
+
+// debouncer merges events for the same path until no new events have been
+// seen for the quiet period, or the max delay has passed since the first
+// event.
+//
+// This is only used from forward(), so doesn't need locking.
+type debouncer struct {
+	quiet, max time.Duration
+	pending    map[string]*pendingEvent
+	seq        uint64
+}
+
+type pendingEvent struct {
+	ev          Event
+	first, last time.Time
+	seq         uint64 // To send events that are due together in the order we first saw them.
+}
+
+func newDebouncer(quiet, max time.Duration) *debouncer {
+	return &debouncer{quiet: quiet, max: max, pending: make(map[string]*pendingEvent)}
+}
+
+func (d *debouncer) add(e Event, now time.Time) {
+	p, ok := d.pending[e.Name]
+	if !ok {
+		d.seq++
+		d.pending[e.Name] = &pendingEvent{ev: e, first: now, last: now, seq: d.seq}
+		return
+	}
+	p.ev.Op |= e.Op
+	if e.RenamedFrom != "" {
+		p.ev.RenamedFrom = e.RenamedFrom
+	}
+	// Use the metadata from the latest event; Rename events don't have a Stat,
+	// but the previous one may still be useful if the file was moved back.
+	p.ev.IsDir = e.IsDir
+	if e.Stat != nil || e.Has(Remove) {
+		p.ev.Stat = e.Stat
+	}
+	p.last = now
+}
+
+// Get the time the event should be sent.
+func (d *debouncer) deadline(p *pendingEvent) time.Time {
+	t := p.last.Add(d.quiet)
+	if d.max > 0 {
+		if m := p.first.Add(d.max); m.Before(t) {
+			return m
+		}
+	}
+	return t
+}
+
+// Get the time until the next event is due, or false if nothing is pending.
+func (d *debouncer) next(now time.Time) (time.Duration, bool) {
+	if len(d.pending) == 0 {
+		return 0, false
+	}
+	var next time.Time
+	for _, p := range d.pending {
+		if t := d.deadline(p); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return max(next.Sub(now), 0), true
+}
+
+// Remove and return all events that are due; all pending events are returned
+// if now is the zero time.
+func (d *debouncer) due(now time.Time) []Event {
+	var due []*pendingEvent
+	for name, p := range d.pending {
+		if now.IsZero() || !d.deadline(p).After(now) {
+			due = append(due, p)
+			delete(d.pending, name)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].seq < due[j].seq })
+
+	evs := make([]Event, 0, len(due))
+	for _, p := range due {
+		evs = append(evs, p.ev)
+	}
+	return evs
+}
@@ -0,0 +1,358 @@
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// pathFilter has the include and exclude patterns for a watch, as set with
+// WithInclude() and WithExclude().
+type pathFilter struct {
+	include, exclude []string
+	git              *gitignore // Set with WithGitignore().
+}
+
+// Get the filter for the options; returns nil if there are no patterns.
+func newPathFilter(with withOpts) *pathFilter {
+	if len(with.include) == 0 && len(with.exclude) == 0 && !with.gitignore {
+		return nil
+	}
+	f := &pathFilter{include: with.include, exclude: with.exclude}
+	if with.gitignore {
+		f.git = newGitignore()
+	}
+	return f
+}
+
+// Report if a watch added with these options needs to be in the filterSet: it
+// has patterns, sets Event.Stat, only watches some operations, or is a parent
+// directory. Watches without any of these can skip filterSet.set().
+func hasFilter(with withOpts) bool {
+	return len(with.include) > 0 || len(with.exclude) > 0 || with.gitignore ||
+		with.stat || with.op != defaultOpts.op || with.parent != nil
+}
+
+// Check that all patterns are valid.
+func validPatterns(patterns ...string) error {
+	for _, p := range patterns {
+		for _, s := range strings.Split(strings.Trim(p, "/"), "/") {
+			if _, err := path.Match(s, ""); err != nil {
+				return fmt.Errorf("fsnotify: invalid pattern %q: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Report if events for path should be skipped; root is the watched path.
+//
+// isDir is only called if a pattern only matches directories. If isDir is nil
+// the path is checked with lstat, and it's assumed to be a directory if it
+// doesn't exist (e.g. for Remove events).
+func (f *pathFilter) skip(root, p string, isDir func() bool) bool {
+	return f.match(root, p, isDir, true)
+}
+
+// Report if path matches an exclude pattern; excluded directories aren't
+// watched or read. Include patterns aren't used, as we still need to look at
+// directories that aren't included for files that are.
+func (f *pathFilter) excluded(root, p string, isDir func() bool) bool {
+	return f.match(root, p, isDir, false)
+}
+
+func (f *pathFilter) match(root, p string, isDir func() bool, include bool) bool {
+	if f == nil || p == root {
+		return false
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+
+	// Check the path and all its parents; everything in an excluded directory
+	// is also excluded, and everything in an included directory is included.
+	var (
+		parts    = strings.Split(filepath.ToSlash(rel), "/")
+		included = !include || len(f.include) == 0
+		parent   = func() bool { return true }
+		last     = sync.OnceValue(func() bool { return isDirectory(p, isDir) })
+	)
+	for i := range parts {
+		dir := parent
+		if i == len(parts)-1 {
+			dir = last
+		}
+		sub := parts[:i+1]
+		for _, pat := range f.exclude {
+			if matchPattern(pat, sub, dir) {
+				return true
+			}
+		}
+		if f.git != nil && f.git.ignored(root, sub, dir) {
+			return true
+		}
+		for _, pat := range f.include {
+			if !included && matchPattern(pat, sub, dir) {
+				included = true
+			}
+		}
+	}
+	return !included
+}
+
+// Stop using the filter; this stops checking if the global gitignore rules
+// changed.
+func (f *pathFilter) close() {
+	if f != nil && f.git != nil {
+		f.git.close()
+	}
+}
+
+// Update the filter for an event; ignore files are read again if they changed.
+func (f *pathFilter) changed(root, path string) {
+	if f != nil && f.git != nil {
+		f.git.changed(root, path)
+	}
+}
+
+// Get a function to use with takeSnapshot() to skip excluded paths; returns nil
+// if f is nil.
+func (f *pathFilter) skipFunc(root string) func(string, func() bool) bool {
+	if f == nil {
+		return nil
+	}
+	return func(path string, isDir func() bool) bool { return f.excluded(root, path, isDir) }
+}
+
+func isDirectory(path string, isDir func() bool) bool {
+	if isDir != nil {
+		return isDir()
+	}
+	fi, err := os.Lstat(path)
+	return err != nil || fi.IsDir()
+}
+
+// Match the pattern against the path, as a list of path components relative
+// to the watched path.
+//
+// Patterns without a "/" match the last component (e.g. "*.go" matches
+// "a/b/file.go"); other patterns match the full path, and "**" matches zero or
+// more components, or one or more at the end. A pattern ending with "/" only
+// matches directories; isDir is only called for these.
+func matchPattern(pat string, parts []string, isDir func() bool) bool {
+	if strings.HasSuffix(pat, "/") {
+		if !isDir() {
+			return false
+		}
+		pat = strings.TrimRight(pat, "/")
+	}
+	if !strings.Contains(pat, "/") {
+		ok, _ := path.Match(pat, parts[len(parts)-1])
+		return ok
+	}
+	return matchParts(strings.Split(strings.TrimLeft(pat, "/"), "/"), parts)
+}
+
+func matchParts(pat, parts []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			// A trailing "**" matches everything in the directory, but not
+			// the directory itself.
+			if len(pat) == 1 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchParts(pat[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], parts[0]); !ok {
+			return false
+		}
+		pat, parts = pat[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// filterSet has the filters and other options that are applied to events
+// before they're sent, for all watches in a backend. The zero value is usable.
+//
+// It also has the parent directories watched for WithNonExistent() and
+// WithFollowName(), which may be the same path as a watch the user added.
+// Events for these are sent to parentWatches, and only sent on if the user
+// watches the path too.
+type filterSet struct {
+	mu      sync.RWMutex
+	roots   map[string]filterRoot // Watched path → filter.
+	parents map[string]Op         // Parent directory → operations it's watched for.
+	parent  *parentWatches
+	n       atomic.Int64 // len(roots) + len(parents), to skip the lock when empty.
+}
+
+type filterRoot struct {
+	recurse bool
+	f       *pathFilter
+	stat    bool // Set Event.Stat; WithStat().
+	op      Op   // WithOps(); only applied if the path is also a parent directory.
+}
+
+// Set the filter for the watched path, replacing any existing filter. For
+// parent directories (asParent()) only the operations are set, and the user's
+// filter for the same path is kept.
+func (s *filterSet) set(path string, recurse bool, f *pathFilter, with withOpts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if with.parent != nil {
+		if s.parents == nil {
+			s.parents = make(map[string]Op)
+		}
+		s.parents[path], s.parent = with.op, with.parent
+		if with.parentOnly {
+			s.roots[path].f.close() // Left over from a watch that's gone.
+			delete(s.roots, path)
+		} else if root, _ := s.find(path); root == "" {
+			// The user's watch didn't need a filter (see hasFilter()), but the
+			// events still need to be told apart from the parent's.
+			if s.roots == nil {
+				s.roots = make(map[string]filterRoot)
+			}
+			s.roots[path] = filterRoot{op: defaultOpts.op}
+		}
+		s.n.Store(int64(len(s.roots) + len(s.parents)))
+		return
+	}
+	if s.roots == nil {
+		s.roots = make(map[string]filterRoot)
+	}
+	if old := s.roots[path].f; old != f {
+		old.close()
+	}
+	s.roots[path] = filterRoot{recurse: recurse, f: f, stat: with.stat, op: with.op}
+	s.n.Store(int64(len(s.roots) + len(s.parents)))
+}
+
+// Get the operations to watch the path with: the operations from with, and
+// those of the parent directory or user's watch that covers the path.
+func (s *filterSet) ops(path string, with withOpts) Op {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if with.parent == nil {
+		return with.op | s.parents[path]
+	}
+	if root, fr := s.find(path); root != "" && !with.parentOnly {
+		return with.op | fr.op
+	}
+	return with.op
+}
+
+// Report if the path is watched as a parent directory.
+func (s *filterSet) isParent(path string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.parents[path]
+	return ok
+}
+
+// Remove the filter for the watched path, which may end with "/...".
+func (s *filterSet) remove(path string) {
+	path, _ = recursivePath(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roots[path].f.close()
+	delete(s.roots, path)
+	delete(s.parents, path)
+	s.n.Store(int64(len(s.roots) + len(s.parents)))
+}
+
+// Stop using all filters, when the backend is closed.
+func (s *filterSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fr := range s.roots {
+		fr.f.close()
+	}
+}
+
+// Report if the path is excluded, and shouldn't be watched.
+func (s *filterSet) excluded(path string, isDir func() bool) bool {
+	root, fr, _ := s.lookup(path)
+	return fr.f.excluded(root, path, isDir)
+}
+
+// Apply the filter for the watch to the event before it's sent. Returns false
+// if the event should be skipped.
+func (s *filterSet) apply(e *Event) bool {
+	if s.n.Load() == 0 {
+		return true
+	}
+	root, fr, parent := s.lookup(e.Name)
+	if parent != nil {
+		parent.event(*e)
+	}
+	if root == "" {
+		return parent == nil
+	}
+	fr.f.changed(root, e.Name)
+	if fr.f.skip(root, e.Name, func() bool { return e.IsDir || isDirectory(e.Name, nil) }) {
+		return false
+	}
+	// The path is watched with the operations of both.
+	if parent != nil {
+		if e.Op &= fr.op; e.Op == 0 {
+			return false
+		}
+	}
+	if fr.stat && e.Op&^(Remove|Rename) != 0 {
+		if fi, err := os.Lstat(e.Name); err == nil {
+			e.Stat, e.IsDir = fi, fi.IsDir()
+		}
+	}
+	return true
+}
+
+// Get the filter for the path; the filter for the watch closest to the path is
+// used if it's covered by more than one watch. The root is "" if no watch the
+// user added covers the path. Also returns where to send the event if it's for
+// a parent directory.
+func (s *filterSet) lookup(path string) (string, filterRoot, *parentWatches) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var parent *parentWatches
+	if len(s.parents) > 0 {
+		if _, ok := s.parents[path]; ok {
+			parent = s.parent
+		} else if _, ok := s.parents[filepath.Dir(path)]; ok {
+			parent = s.parent
+		}
+	}
+	root, fr := s.find(path)
+	return root, fr, parent
+}
+
+// Get the user's watch closest to the path; must hold mu.
+func (s *filterSet) find(path string) (string, filterRoot) {
+	if len(s.roots) == 0 {
+		return "", filterRoot{}
+	}
+	// Non-recursive watches cover the path itself and the files in it.
+	for dir, i := path, 0; ; i++ {
+		if fr, ok := s.roots[dir]; ok && (i < 2 || fr.recurse) {
+			return dir, fr
+		}
+		d := filepath.Dir(dir)
+		if d == dir {
+			return "", filterRoot{}
+		}
+		dir = d
+	}
+}
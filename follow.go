@@ -0,0 +1,264 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long to wait for a file to be created again after it's removed or
+// renamed, before sending the Remove or Rename for paths added with
+// WithFollowName().
+var followGrace = 100 * time.Millisecond
+
+// followWatches has the paths added with WithFollowName(), which are watched
+// through their parent directory as a parentWatches.
+type followWatches struct {
+	out     *shared        // Send events and errors to the Watcher.
+	parents *parentWatches // Watches the parent directories.
+	events  chan Event     // Events for the parent directories.
+	stop    chan struct{}
+	done    chan struct{}
+
+	addMu sync.Mutex // Serializes add() and remove().
+	mu    sync.Mutex
+	files map[string]*followFile // Path → state.
+	dirs  map[string]int         // Watched directory → number of files in it.
+}
+
+type followFile struct {
+	op      Op    // Operations to send; WithOps().
+	exists  bool  // File exists, as far as we know.
+	removed Op    // Remove or Rename that wasn't sent yet.
+	ev      Event // Event removed was seen in.
+}
+
+func newFollowWatches(w *Watcher, parents *parentWatches) *followWatches {
+	f := &followWatches{
+		out:     newShared(w.events, w.errors, w.backendSeq()),
+		parents: parents,
+		events:  make(chan Event),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		files:   make(map[string]*followFile),
+		dirs:    make(map[string]int),
+	}
+	go f.run()
+	return f
+}
+
+func (f *followWatches) close() {
+	f.out.close()
+	close(f.stop)
+	<-f.done
+}
+
+// Handle an event for a parent directory.
+func (f *followWatches) event(e Event) {
+	select {
+	case f.events <- e:
+	case <-f.stop:
+	}
+}
+
+func (f *followWatches) add(path string, with withOpts) error {
+	if _, recurse := recursivePath(path); recurse {
+		return fmt.Errorf("%w: WithFollowName can't be used with recursive watches", ErrUnsupported)
+	}
+	path = filepath.Clean(path)
+	_, err := os.Lstat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	exists := err == nil
+
+	f.addMu.Lock()
+	defer f.addMu.Unlock()
+	f.mu.Lock()
+	if ff, ok := f.files[path]; ok {
+		ff.op = with.op
+		f.mu.Unlock()
+		return nil
+	}
+	f.mu.Unlock()
+
+	dir := filepath.Dir(path)
+	err = f.parents.add(dir, Create|Write|Remove|Rename|Chmod, with.pollInterval)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirs[dir]++
+	f.files[path] = &followFile{op: with.op, exists: exists}
+	f.out.filters.set(path, false, nil, with)
+	return nil
+}
+
+// Remove a path; returns false if it's not watched.
+func (f *followWatches) remove(path string) bool {
+	path = filepath.Clean(path)
+	f.addMu.Lock()
+	defer f.addMu.Unlock()
+	f.mu.Lock()
+	if _, ok := f.files[path]; !ok {
+		f.mu.Unlock()
+		return false
+	}
+	f.drop(path)
+	f.mu.Unlock()
+	return true
+}
+
+// Stop watching the path; must hold mu.
+func (f *followWatches) drop(path string) {
+	delete(f.files, path)
+	f.out.filters.remove(path)
+	dir := filepath.Dir(path)
+	if f.dirs[dir]--; f.dirs[dir] <= 0 {
+		delete(f.dirs, dir)
+	}
+	f.parents.remove(dir)
+}
+
+func (f *followWatches) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l := make([]string, 0, len(f.files))
+	for path := range f.files {
+		l = append(l, path)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (f *followWatches) run() {
+	defer close(f.done)
+
+	var (
+		timer  = time.NewTimer(time.Hour)
+		timerC <-chan time.Time
+	)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		timerC = nil
+		if d, ok := f.next(time.Now()); ok {
+			timer.Reset(d)
+			timerC = timer.C
+		}
+
+		var evs []Event
+		select {
+		case e := <-f.events:
+			evs = f.handle(e)
+		case <-f.stop:
+			return
+		case <-timerC:
+			evs = f.due(time.Now())
+		}
+		for _, e := range evs {
+			if !f.out.sendEvent(e) {
+				return
+			}
+		}
+	}
+}
+
+// Handle an event for a parent directory, and return the events to send.
+func (f *followWatches) handle(e Event) []Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ff, ok := f.files[e.Name]
+	if !ok {
+		// The directory is gone, and the watch along with it.
+		if !e.Has(Remove | Rename) {
+			return nil
+		}
+		var evs []Event
+		for path, ff := range f.files {
+			if filepath.Dir(path) != e.Name {
+				continue
+			}
+			op := ff.removed
+			if op == 0 && ff.exists {
+				op = e.Op & (Remove | Rename)
+			}
+			if op&ff.op != 0 {
+				evs = append(evs, Event{Name: path, Op: op & ff.op, Time: e.Time})
+			}
+			f.drop(path)
+		}
+		sort.Slice(evs, func(i, j int) bool { return evs[i].Name < evs[j].Name })
+		return evs
+	}
+
+	op := e.Op &^ (Create | Remove | Rename)
+	switch {
+	case e.Has(Create):
+		// Replaced with a rename or created again after a remove: send it as a
+		// Write, as the path still refers to "the same file".
+		if ff.exists || ff.removed != 0 {
+			op |= Write
+		} else {
+			op |= Create
+		}
+		ff.exists, ff.removed = true, 0
+	case e.Has(Remove | Rename):
+		// Wait to see if it's created again.
+		ff.removed, ff.ev = Remove, e
+		if !e.Has(Remove) {
+			ff.removed = Rename
+		}
+		ff.exists = false
+	}
+	if op&ff.op == 0 {
+		return nil
+	}
+	return []Event{{Name: e.Name, Op: op & ff.op, IsDir: e.IsDir, Time: e.Time}}
+}
+
+// Get the time until the next Remove or Rename is due, or false if there's
+// nothing pending.
+func (f *followWatches) next(now time.Time) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var (
+		next time.Time
+		ok   bool
+	)
+	for _, ff := range f.files {
+		if ff.removed == 0 {
+			continue
+		}
+		if t := ff.ev.Time.Add(followGrace); !ok || t.Before(next) {
+			next, ok = t, true
+		}
+	}
+	return max(next.Sub(now), 0), ok
+}
+
+// Get the Remove and Rename events that are due.
+func (f *followWatches) due(now time.Time) []Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var evs []Event
+	for path, ff := range f.files {
+		if ff.removed == 0 || ff.ev.Time.Add(followGrace).After(now) {
+			continue
+		}
+		if ff.removed&ff.op != 0 {
+			evs = append(evs, Event{Name: path, Op: ff.removed & ff.op, IsDir: ff.ev.IsDir, Time: ff.ev.Time})
+		}
+		ff.removed = 0
+	}
+	sort.Slice(evs, func(i, j int) bool { return evs[i].Time.Before(evs[j].Time) })
+	return evs
+}
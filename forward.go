@@ -0,0 +1,172 @@
+package fsnotify
+
+import (
+	"errors"
+	"time"
+)
+
+// Forward the events and errors from the backend to the Events and Errors
+// channels, for options that need to process events before they're sent:
+// resyncing after overflows, pairing renames, and debouncing.
+func (w *Watcher) forward() {
+	defer func() {
+		close(w.Events)
+		close(w.Errors)
+		close(w.forwardDone)
+	}()
+
+	var (
+		events = w.events
+		errs   = w.errors
+		timer  = time.NewTimer(time.Hour)
+		timerC <-chan time.Time
+	)
+	timer.Stop()
+	for events != nil || errs != nil {
+		timerC = nil
+		if d, ok := w.nextDue(time.Now()); ok && !w.isClosed() {
+			timer.Reset(d)
+			timerC = timer.C
+		}
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if w.resync != nil {
+				w.resync.update(e)
+			}
+			w.pair(e)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if !w.sendError(err) || w.resync == nil || !errors.Is(err, ErrEventOverflow) {
+				continue
+			}
+			for _, e := range w.resync.resync() {
+				if !w.pair(e) {
+					break
+				}
+			}
+		case <-timerC:
+			now := time.Now()
+			if w.pairer != nil {
+				for _, e := range w.pairer.due(now) {
+					if !w.emit(e) {
+						break
+					}
+				}
+			}
+			if w.debounce != nil {
+				for _, e := range w.debounce.due(now) {
+					if !w.sendEvent(e) {
+						break
+					}
+				}
+			}
+		}
+	}
+	timer.Stop()
+
+	// Flush pending events, but don't wait forever if no one is reading the
+	// Events channel.
+	var (
+		flush []Event
+		wait  = time.Second
+	)
+	if w.pairer != nil {
+		flush = w.pairer.flush()
+	}
+	if w.debounce != nil {
+		for _, e := range flush {
+			w.debounce.add(e, time.Now())
+		}
+		flush, wait = w.debounce.due(time.Time{}), min(w.debounce.quiet, wait)
+	}
+	for _, e := range flush {
+		w.seq.stamp(&e)
+		select {
+		case w.Events <- e:
+			w.stats.sent.Add(1)
+		case <-time.After(wait):
+			return
+		}
+	}
+}
+
+// Get the time until the next held event is due, or false if nothing is held.
+func (w *Watcher) nextDue(now time.Time) (time.Duration, bool) {
+	var (
+		d  time.Duration
+		ok bool
+	)
+	if w.pairer != nil {
+		d, ok = w.pairer.next(now)
+	}
+	if w.debounce != nil {
+		if dd, dok := w.debounce.next(now); dok && (!ok || dd < d) {
+			d, ok = dd, true
+		}
+	}
+	return d, ok
+}
+
+// Hold the event if it may need to be paired with a rename, or otherwise emit
+// it. Returns false if the Watcher is closed.
+func (w *Watcher) pair(e Event) bool {
+	if w.pairer == nil {
+		return w.emit(e)
+	}
+	for _, e := range w.pairer.add(e, time.Now()) {
+		if !w.emit(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Send the event, or add it to the debouncer. Returns false if the Watcher is
+// closed.
+func (w *Watcher) emit(e Event) bool {
+	if w.debounce != nil {
+		w.debounce.add(e, time.Now())
+		return true
+	}
+	return w.sendEvent(e)
+}
+
+func (w *Watcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send to the user; returns false if the Watcher is closed. We keep reading
+// from the backend until it closes the channels.
+func (w *Watcher) sendEvent(e Event) bool {
+	w.seq.stamp(&e)
+	w.stats.sent.Add(1) // Before sending, so that it's counted once received.
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+func (w *Watcher) sendError(err error) bool {
+	w.stats.errors.Add(1)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
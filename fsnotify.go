@@ -3,10 +3,21 @@
 //
 // Currently supported systems:
 //
-//   - Linux      via inotify
+//   - Linux      via inotify, or fanotify with [WithFanotify]
 //   - BSD, macOS via kqueue
 //   - Windows    via ReadDirectoryChangesW
 //   - illumos    via FEN
+//   - All others via polling
+//
+// Polling can also be used for specific paths with [WithPolling], or for all
+// paths with [WithPollingBackend]; this is useful for network filesystems
+// (NFS, SMB, FUSE, etc.) where the native backends generally don't work.
+//
+// # Recursive watches
+//
+// Add a path with "/..." appended to also watch all subdirectories; see
+// [Watcher.Add] for details. This is supported on Linux, Windows, and with
+// polling; other platforms return [ErrUnsupported].
 //
 // # FSNOTIFY_DEBUG
 //
@@ -19,17 +30,24 @@
 //
 // Example output:
 //
-//	FSNOTIFY_DEBUG: 11:34:23.633087586   256:IN_CREATE            → "/tmp/file-1"
-//	FSNOTIFY_DEBUG: 11:34:23.633202319     4:IN_ATTRIB            → "/tmp/file-1"
-//	FSNOTIFY_DEBUG: 11:34:28.989728764   512:IN_DELETE            → "/tmp/file-1"
+//	FSNOTIFY_DEBUG: 11:34:23.633087586  IN_CREATE                      → "/tmp/file-1"
+//	FSNOTIFY_DEBUG: 11:34:23.633202319  IN_ATTRIB                      → "/tmp/file-1"
+//	FSNOTIFY_DEBUG: 11:34:28.989728764  IN_DELETE                      → "/tmp/file-1"
+//
+// Use [WithLogger] to send the same information to a [slog.Logger] instead.
 package fsnotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Watcher watches a set of paths, delivering events on a channel.
@@ -52,8 +70,9 @@ import (
 // for the number of watches per user, and fs.inotify.max_user_instances
 // specifies the maximum number of inotify instances per user. Every Watcher you
 // create is an "instance", and every path you add is a "watch". Reaching the
-// limit will result in a "no space left on device" or "too many open files"
-// error.
+// limit will result in an [ErrWatchLimit] or [ErrInstanceLimit] error. Use
+// [SystemLimits] to get the current limits, [Watcher.WatchCount] to get the
+// number of watches a Watcher uses, and [WithMaxWatches] to limit it.
 //
 // These are also exposed in /proc as /proc/sys/fs/inotify/max_user_watches and
 // /proc/sys/fs/inotify/max_user_instances. The default values differ per distro
@@ -94,6 +113,34 @@ import (
 type Watcher struct {
 	b backend
 
+	// Channels the backends send to; the same as Events and Errors, unless
+	// events are forwarded with forward().
+	events      chan Event
+	errors      chan error
+	seq         *sequence     // Sequence numbers for events.
+	resync      *resyncer     // Resync after overflows; nil if not enabled.
+	state       *stateStore   // WithStateFile(); nil if not enabled.
+	debounce    *debouncer    // Debounce events; nil if not enabled.
+	pairer      *renamePairer // Pair renames; nil if not enabled.
+	done        chan struct{} // Closed on Close() if forwarding.
+	forwardDone chan struct{} // Closed when forward() is done.
+
+	opts    watcherOpts
+	pollMu  sync.Mutex
+	poll    *polling        // Polling backend for paths added with WithPolling().
+	pending *pendingWatches // Paths added with WithNonExistent().
+	follow  *followWatches  // Paths added with WithFollowName().
+	parents *parentWatches  // Parent directories for pending and follow.
+	closed  bool
+	stats   statCounters // Events and errors sent by forward().
+
+	subMu       sync.Mutex
+	subs        []*Subscription // Subscriptions from Subscribe().
+	subsStarted bool            // dispatch() was started.
+	subsDone    bool            // dispatch() is done; no new subscriptions.
+
+	handler *handler // WithHandler(); nil if not used.
+
 	// Events sends the filesystem change events.
 	//
 	// fsnotify can send Create, Remove, Rename, Write, or Chmod events. See the
@@ -127,7 +174,45 @@ type Event struct {
 	//
 	//   Event{Op: Rename, Name: "/tmp/file"}
 	//   Event{Op: Create, Name: "/tmp/rename", RenamedFrom: "/tmp/file"}
-	renamedFrom string
+	//
+	// It's only ever set on Create events, and only on Linux and Windows; it's
+	// always empty on other platforms. When it is set the Rename event for the
+	// old path will always be sent before the Create event. It may be empty
+	// even if the path was renamed inside a watched directory, for example on
+	// Linux when there are many renames that are not directly followed by
+	// their destination (only the last 10 renames are remembered).
+	RenamedFrom string
+
+	// IsDir is set if the path is a directory.
+	//
+	// On Linux this is reported by the kernel, and on BSD, macOS, illumos, and
+	// with polling it's known from the state fsnotify keeps; no extra syscalls
+	// are needed. It's not set by the Windows backend, unless [WithStat] is used.
+	IsDir bool
+
+	// Stat is the result of lstat on the path when the event was sent, for
+	// paths added with [WithStat]. Use Stat.Sys() to get the inode and device
+	// numbers (a *syscall.Stat_t on Unix systems).
+	//
+	// This is nil if WithStat wasn't used, for events with only [Remove] or
+	// [Rename], or if the path no longer existed by the time the event was
+	// sent. The path may have changed again after the lstat.
+	Stat fs.FileInfo
+
+	// Time is when the event was read from the kernel; this is when fsnotify
+	// saw the change, not when it happened. For polling it's when the change
+	// was found, and for events merged with [WithDebounce] it's the time of the
+	// first event.
+	Time time.Time
+
+	// Seq is the sequence number of the event, starting at 1 and incremented
+	// for every event sent by the Watcher. Events are sent in order of Seq,
+	// except that events for paths added with [WithPolling], [WithNonExistent]
+	// (the Create event when the path is added), and [WithFollowName] are sent
+	// from a different goroutine and may be interleaved out of order with
+	// events from the native backend, unless [WithDebounce] or
+	// [WithResyncOnOverflow] is used.
+	Seq uint64
 }
 
 // Op describes a set of file operations.
@@ -145,7 +230,7 @@ const (
 	// or multiple writes, depending on when the system syncs things to disk.
 	// For example when compiling a large Go program you may get hundreds of
 	// Write events, and you may want to wait until you've stopped receiving
-	// them (see the dedup example in cmd/fsnotify).
+	// them (see [WithDebounce]).
 	Write
 
 	// The path was removed; any watches on it will be removed. Some "remove"
@@ -159,6 +244,9 @@ const (
 	// unmonitored file into a monitored directory will show up as just a
 	// Create. Similarly, renaming a file to outside a monitored directory will
 	// show up as only a Rename.
+	//
+	// The Create event for the new path will have [Event.RenamedFrom] set to
+	// the old path on platforms that support it.
 	Rename
 
 	// Attributes were changed. On Linux this is also sent when a file is
@@ -172,28 +260,44 @@ const (
 
 	// File descriptor was opened.
 	//
-	// Only works on Linux and FreeBSD.
-	xUnportableOpen
+	// Only works on Linux; use [Watcher.Supports] to check for support.
+	UnportableOpen
 
 	// File was read from.
 	//
-	// Only works on Linux and FreeBSD.
-	xUnportableRead
+	// Only works on Linux; use [Watcher.Supports] to check for support.
+	UnportableRead
 
 	// File opened for writing was closed.
 	//
-	// Only works on Linux and FreeBSD.
+	// Only works on Linux; use [Watcher.Supports] to check for support.
 	//
 	// The advantage of using this over Write is that it's more reliable than
 	// waiting for Write events to stop. It's also faster (if you're not
 	// listening to Write events): copying a file of a few GB can easily
 	// generate tens of thousands of Write events in a short span of time.
-	xUnportableCloseWrite
+	UnportableCloseWrite
 
 	// File opened for reading was closed.
 	//
-	// Only works on Linux.
-	xUnportableCloseRead
+	// Only works on Linux; use [Watcher.Supports] to check for support.
+	UnportableCloseRead
+
+	// The watch was removed by the system, rather than with [Watcher.Remove]:
+	// the watched path was removed or renamed, or the filesystem it's on was
+	// unmounted. Event.Name is the path that's no longer watched. This is sent
+	// after the Remove or Rename event for the path, or with
+	// [UnportableUnmount].
+	//
+	// Only works on Linux; use [Watcher.Supports] to check for support.
+	UnportableUnwatch
+
+	// The filesystem the watched path is on was unmounted; the watch is
+	// removed. This is sent for every watch on the filesystem, including
+	// subdirectories in recursive watches.
+	//
+	// Only works on Linux; use [Watcher.Supports] to check for support.
+	UnportableUnmount
 )
 
 var (
@@ -212,24 +316,84 @@ var (
 	//                  sysctl can be used to increase this).
 	//  - windows:      The buffer size is too small; WithBufferSize() can be used to increase it.
 	//  - kqueue, fen:  Not used.
+	//
+	// Use [WithResyncOnOverflow] to rescan all watched paths and send events
+	// for the changes that were missed.
 	ErrEventOverflow = errors.New("fsnotify: queue or buffer overflow")
 
 	// ErrUnsupported is returned by AddWith() when WithOps() specified an
-	// Unportable event that's not supported on this platform.
+	// Unportable event that's not supported on this platform, or by Add() when
+	// adding a recursive watch on a platform that doesn't support it.
 	//lint:ignore ST1012 not relevant
-	xErrUnsupported = errors.New("fsnotify: not supported with this backend")
+	ErrUnsupported = errors.New("fsnotify: not supported with this backend")
+
+	// ErrWatchLimit is returned by AddWith(), or reported from the Errors
+	// channel for watches added automatically, when a watch can't be added
+	// because a limit was reached:
+	//
+	//  - inotify:   fs.inotify.max_user_watches (ENOSPC).
+	//  - fanotify:  fs.fanotify.max_user_marks (ENOSPC).
+	//  - kqueue:    the maximum number of open files (EMFILE or ENFILE).
+	//  - all:       the budget set with [WithMaxWatches].
+	//
+	// The error message names the limit that was reached, and the underlying
+	// error is wrapped.
+	ErrWatchLimit = errors.New("fsnotify: watch limit reached")
+
+	// ErrInstanceLimit is returned by NewWatcher() when a new inotify or
+	// fanotify instance can't be created because fs.inotify.max_user_instances
+	// or fs.fanotify.max_user_groups was reached (EMFILE).
+	ErrInstanceLimit = errors.New("fsnotify: instance limit reached")
 )
 
-// NewWatcher creates a new Watcher.
-func NewWatcher() (*Watcher, error) {
-	ev, errs := make(chan Event, defaultBufferSize), make(chan error)
-	b, err := newBackend(ev, errs)
-	if err != nil {
-		return nil, err
+// WatchError is sent on the Errors channel for errors with a specific path,
+// such as failing to add a watch for a new subdirectory in a recursive watch,
+// or failing to scan a path added with [WithPolling]. Use [errors.As] to get
+// it:
+//
+//	var werr *fsnotify.WatchError
+//	if errors.As(err, &werr) {
+//		fmt.Println("error for", werr.Path)
+//	}
+//
+// Errors that aren't for a specific path, such as [ErrEventOverflow] or errors
+// reading from the kernel, aren't wrapped.
+type WatchError struct {
+	// Operation that failed:
+	//
+	//   - "add":    adding a watch, e.g. for a new subdirectory.
+	//   - "remove": removing a watch, e.g. after the path was removed.
+	//   - "read":   reading the path, e.g. listing a directory.
+	Op   string
+	Path string // Path the error is for.
+	Err  error  // Underlying error.
+}
+
+func (e *WatchError) Error() string {
+	return fmt.Sprintf("fsnotify: %s %q: %s", e.Op, e.Path, e.Err)
+}
+
+func (e *WatchError) Unwrap() error { return e.Err }
+
+// Wrap err in a WatchError; returns nil if err is nil.
+func watchError(op, path string, err error) error {
+	if err == nil {
+		return nil
 	}
-	return &Watcher{b: b, Events: ev, Errors: errs}, nil
+	return &WatchError{Op: op, Path: path, Err: err}
+}
+
+// Limits are the system limits for inotify, as read from /proc/sys/fs/inotify.
+// See the "Linux notes" on [Watcher] for details.
+type Limits struct {
+	MaxUserWatches   int // fs.inotify.max_user_watches
+	MaxUserInstances int // fs.inotify.max_user_instances
+	MaxQueuedEvents  int // fs.inotify.max_queued_events
 }
 
+// NewWatcher creates a new Watcher.
+func NewWatcher() (*Watcher, error) { return NewWatcherWith() }
+
 // NewBufferedWatcher creates a new Watcher with a buffered Watcher.Events
 // channel.
 //
@@ -239,26 +403,96 @@ func NewWatcher() (*Watcher, error) {
 // cases, and whenever possible you will be better off increasing the kernel
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) {
-	ev, errs := make(chan Event, sz), make(chan error)
-	b, err := newBackend(ev, errs)
+	return NewWatcherWith(func(opt *watcherOpts) { opt.bufsize = sz })
+}
+
+// NewWatcherWith is like [NewWatcher], but allows adding options.
+//
+// Possible options are:
+//
+//   - [WithPollingBackend] uses the polling backend for all paths, instead of
+//     the platform's native backend.
+//   - [WithFanotify] uses the fanotify backend on Linux, instead of inotify.
+//   - [WithResyncOnOverflow] rescans all watched paths after an
+//     [ErrEventOverflow].
+//   - [WithDebounce] merges events for the same path that are sent in quick
+//     succession.
+//   - [WithRenamePairing] waits for the new name of renamed paths, and sends
+//     Remove for paths moved out of the watched paths.
+//   - [WithMaxWatches] sets the maximum number of watches the Watcher can use.
+//   - [WithLogger] logs debug information to a [slog.Logger].
+//   - [WithStateFile] sends events for changes made while the program wasn't
+//     running.
+//   - [WithHandler] calls functions for every event and error, instead of
+//     sending them on the Events and Errors channels.
+//   - [WithHandlerWorkers] calls the event handler from more than one
+//     goroutine.
+func NewWatcherWith(opts ...watcherOpt) (*Watcher, error) {
+	with := getWatcherOptions(opts...)
+	w := &Watcher{Events: make(chan Event, with.bufsize), Errors: make(chan error), seq: new(sequence), opts: with}
+	w.events, w.errors = w.Events, w.Errors
+	if with.stateFile != "" {
+		var err error
+		w.state, err = loadState(with.stateFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if with.resync || w.state != nil {
+		w.resync = newResyncer()
+	}
+	if with.debounce > 0 {
+		w.debounce = newDebouncer(with.debounce, with.debounceMax)
+	}
+	if with.renameWindow > 0 {
+		w.pairer = newRenamePairer(with.renameWindow)
+	}
+	if w.resync != nil || w.debounce != nil || w.pairer != nil {
+		w.events, w.errors = make(chan Event), make(chan error)
+	}
+
+	var err error
+	switch {
+	case with.pollInterval > 0:
+		w.b = newPollingBackend(w.events, w.errors, w.backendSeq(), with.pollInterval, true)
+	case with.fanotify:
+		w.b, err = newFanotifyBackend(w.events, w.errors, w.backendSeq())
+	default:
+		w.b, err = newBackend(w.events, w.errors, w.backendSeq())
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &Watcher{b: b, Events: ev, Errors: errs}, nil
+	if w.state != nil && !supportsExisting(w.b) {
+		w.b.Close()
+		return nil, fmt.Errorf("%w: WithStateFile needs the inotify, fanotify, or polling backend", ErrUnsupported)
+	}
+	w.b.setOpts(with)
+
+	if w.events != w.Events {
+		w.done, w.forwardDone = make(chan struct{}), make(chan struct{})
+		go w.forward()
+	}
+	if with.onEvent != nil || with.onError != nil {
+		w.handler = newHandler(with.onEvent, with.onError, with.workers, with.bufsize)
+		go w.handle()
+	}
+	return w, nil
 }
 
 // Add starts monitoring the path for changes.
 //
 // A path can only be watched once; watching it more than once is a no-op and will
 // not return an error. Paths that do not yet exist on the filesystem cannot be
-// watched.
+// watched, unless [WithNonExistent] is used.
 //
 // A watch will be automatically removed if the watched path is deleted or
 // renamed. The exception is the Windows backend, which doesn't remove the
 // watcher on renames.
 //
 // Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
-// filesystems (/proc, /sys, etc.) generally don't work.
+// filesystems (/proc, /sys, etc.) generally don't work. Use [WithPolling] to
+// poll these paths for changes, or [WithPollingBackend] to poll all paths.
 //
 // Returns [ErrClosed] if [Watcher.Close] was called.
 //
@@ -268,7 +502,27 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 //
 // All files in a directory are monitored, including new files that are created
 // after the watcher is started. Subdirectories are not watched (i.e. it's
-// non-recursive).
+// non-recursive), unless you add a recursive watch.
+//
+// # Recursive watches
+//
+// Add "/..." to the path to watch the directory and all its subdirectories
+// (e.g. Add("dir/...")); "\..." also works on Windows. The path must be a
+// directory.
+//
+// New subdirectories are watched as they're created. On Linux a Create event is
+// also sent for all files and directories that already exist in the new
+// directory by the time the watch is set up, so that paths created with e.g.
+// "mkdir -p dir/one/two" or moved in from outside the watched tree aren't
+// missed. A path may be reported more than once if it's created while the watch
+// is being set up.
+//
+// Recursive watches are supported on Linux, Windows, and for paths added with
+// [WithPolling]; [ErrUnsupported] is returned on other platforms.
+//
+// On Linux every subdirectory uses a watch from the fs.inotify.max_user_watches
+// limit. The fanotify backend ([WithFanotify]) uses a single filesystem mark
+// instead.
 //
 // # Watching files
 //
@@ -281,9 +535,10 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 // The upshot of this is that a power failure or crash won't leave a
 // half-written file.
 //
-// Watch the parent directory and use Event.Name to filter out files you're not
-// interested in. There is an example of this in cmd/fsnotify/file.go.
-func (w *Watcher) Add(path string) error { return w.b.Add(path) }
+// Use [WithFollowName] to watch the file through its parent directory, or
+// watch the parent directory yourself and use Event.Name to filter out files
+// you're not interested in. There is an example of this in cmd/fsnotify/file.go.
+func (w *Watcher) Add(path string) error { return w.AddWith(path) }
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
 // the defaults described below are used.
@@ -292,33 +547,483 @@ func (w *Watcher) Add(path string) error { return w.b.Add(path) }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
-func (w *Watcher) AddWith(path string, opts ...addOpt) error { return w.b.AddWith(path, opts...) }
+//   - [WithOps] sets which operations to listen for. The default is [Create],
+//     [Write], [Remove], [Rename], and [Chmod].
+//   - [WithPolling] polls this path for changes, instead of using the
+//     platform's native backend.
+//   - [WithMountMark] and [WithFilesystemMark] watch the entire mount or
+//     filesystem the path is on; only supported with [WithFanotify].
+//   - [WithInclude] and [WithExclude] only send events for paths matching (or
+//     not matching) a set of patterns.
+//   - [WithGitignore] doesn't send events for paths ignored by git.
+//   - [WithStat] sets [Event.Stat] to the file's metadata.
+//   - [WithNonExistent] allows adding a path that doesn't exist yet.
+//   - [WithFollowName] watches a file by its name, so that the watch isn't lost
+//     if the file is replaced.
+//   - [WithSymlinks] sets if symlinks are followed.
+//   - [WithExisting] sends a [Create] event for everything that already
+//     exists.
+//
+// Returns [ErrUnsupported] if an option isn't supported on this platform, such
+// as an unportable operation in [WithOps]. Nothing is added in that case.
+func (w *Watcher) AddWith(path string, opts ...addOpt) error {
+	with := getOptions(opts...)
+	if with.mark != markInode && !isFanotify(w.b) {
+		return fmt.Errorf("%w: mount and filesystem marks need the fanotify backend", ErrUnsupported)
+	}
+	if with.symlinks != symlinkDefault && (with.pollInterval > 0 || !isInotify(w.b)) {
+		return fmt.Errorf("%w: WithSymlinks needs the inotify backend", ErrUnsupported)
+	}
+	if with.existing && (with.followName || !(with.pollInterval > 0 || supportsExisting(w.b))) {
+		return fmt.Errorf("%w: WithExisting needs the inotify, fanotify, or polling backend", ErrUnsupported)
+	}
+	for _, p := range [][]string{with.include, with.exclude} {
+		if err := validPatterns(p...); err != nil {
+			return err
+		}
+	}
+
+	if with.nonExistent {
+		target, _ := recursivePath(path)
+		if _, err := os.Stat(target); errors.Is(err, fs.ErrNotExist) {
+			p, err := w.pendingWatches()
+			if err != nil {
+				return err
+			}
+			return p.add(path, opts, with)
+		}
+	}
+	return w.add(path, opts, with)
+}
+
+func (w *Watcher) add(path string, opts []addOpt, with withOpts) error {
+	var saved snapshot
+	if w.state != nil && !with.followName {
+		saved = w.state.get(path)
+		if saved != nil {
+			opts = append(opts[:len(opts):len(opts)], func(opt *withOpts) { opt.saved = saved })
+		}
+	}
+
+	var err error
+	if with.followName {
+		var f *followWatches
+		f, err = w.followWatches()
+		if err == nil {
+			err = f.add(path, with)
+		}
+	} else if _, ok := w.b.(*polling); !ok && with.pollInterval > 0 {
+		var p *polling
+		p, err = w.poller()
+		if err == nil {
+			err = p.AddWith(path, opts...)
+		}
+		if err == nil {
+			w.userAdded(p, path)
+		}
+	} else {
+		err = w.b.AddWith(path, opts...)
+		if err == nil {
+			w.userAdded(w.b, path)
+		}
+	}
+	if err == nil && w.resync != nil {
+		w.resync.add(path, with)
+	}
+	if err == nil && saved != nil {
+		w.state.remove(path)
+	}
+	return err
+}
+
+// Report if the backend can send the events for WithExisting() and
+// WithStateFile().
+func supportsExisting(b backend) bool {
+	_, polling := b.(*polling)
+	return polling || isInotify(b) || isFanotify(b)
+}
+
+// Get the sequence for the backends to use; nil if the events are forwarded,
+// as forward() sets the sequence numbers after merging events.
+func (w *Watcher) backendSeq() *sequence {
+	if w.events != w.Events {
+		return nil
+	}
+	return w.seq
+}
+
+// Get the polling backend for WithPolling(), creating it if needed.
+func (w *Watcher) poller() (*polling, error) {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if w.poll == nil {
+		w.poll = newPollingBackend(w.events, w.errors, w.backendSeq(), 0, false)
+		w.poll.setOpts(w.opts)
+	}
+	return w.poll, nil
+}
+
+// Get the watches for WithFollowName(), creating them if needed.
+func (w *Watcher) followWatches() (*followWatches, error) {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if w.follow == nil {
+		w.follow = newFollowWatches(w, w.parentWatches())
+	}
+	return w.follow, nil
+}
+
+// Get the pending watches for WithNonExistent(), creating them if needed.
+func (w *Watcher) pendingWatches() (*pendingWatches, error) {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if w.pending == nil {
+		w.pending = newPendingWatches(w, w.parentWatches())
+	}
+	return w.pending, nil
+}
+
+// Get the parent directory watches, creating them if needed; must hold pollMu.
+func (w *Watcher) parentWatches() *parentWatches {
+	if w.parents == nil {
+		w.parents = newParentWatches(w)
+	}
+	return w.parents
+}
+
+// Send an event for a parent directory to the pending and follow watches.
+func (w *Watcher) parentEvent(e Event) {
+	w.pollMu.Lock()
+	pending, follow := w.pending, w.follow
+	w.pollMu.Unlock()
+	if pending != nil {
+		pending.handle(e)
+	}
+	if follow != nil {
+		follow.event(e)
+	}
+}
+
+// The user added path to b.
+func (w *Watcher) userAdded(b backend, path string) {
+	w.pollMu.Lock()
+	parents := w.parents
+	w.pollMu.Unlock()
+	if parents != nil {
+		parents.userAdded(b, path)
+	}
+}
 
 // Remove stops monitoring the path for changes.
 //
 // Directories are always removed non-recursively. For example, if you added
 // /tmp/dir and /tmp/dir/subdir then you will need to remove both.
 //
+// Recursive watches are removed with the path as it was added, with or without
+// the "/..." suffix; both Remove("dir/...") and Remove("dir") remove the watch
+// for "dir" and all its subdirectories. Using "/..." for a path that was added
+// non-recursively is an error.
+//
 // Removing a path that has not yet been added returns [ErrNonExistentWatch].
 //
 // Returns nil if [Watcher.Close] was called.
-func (w *Watcher) Remove(path string) error { return w.b.Remove(path) }
+func (w *Watcher) Remove(path string) error {
+	w.pollMu.Lock()
+	p, pending, follow, parents := w.poll, w.pending, w.follow, w.parents
+	w.pollMu.Unlock()
+	if pending != nil && pending.remove(path) {
+		return nil
+	}
+	if follow != nil && follow.remove(path) {
+		if w.resync != nil {
+			w.resync.remove(path)
+		}
+		if w.state != nil {
+			w.state.remove(path)
+		}
+		return nil
+	}
+	// The parent directories are watched on the backends as well, but the
+	// user can't remove those.
+	remove := func(b backend) error {
+		if parents == nil {
+			return b.Remove(path)
+		}
+		if parents.only(b, path) {
+			return fmt.Errorf("%w: %s", ErrNonExistentWatch, path)
+		}
+		err := b.Remove(path)
+		if err == nil {
+			parents.userRemoved(b, path)
+		}
+		return err
+	}
+	err := ErrNonExistentWatch
+	if p != nil {
+		err = remove(p)
+	}
+	if errors.Is(err, ErrNonExistentWatch) {
+		err = remove(w.b)
+	}
+	if err == nil && w.resync != nil {
+		w.resync.remove(path)
+	}
+	if err == nil && w.state != nil {
+		w.state.remove(path)
+	}
+	return err
+}
 
 // Close removes all watches and closes the Events channel.
-func (w *Watcher) Close() error { return w.b.Close() }
+func (w *Watcher) Close() error {
+	w.pollMu.Lock()
+	if w.done != nil && !w.closed {
+		close(w.done)
+	}
+	save := w.state != nil && !w.closed
+	w.closed = true
+	p, pending, follow, parents := w.poll, w.pending, w.follow, w.parents
+	w.pollMu.Unlock()
+	w.cancelSubscriptions()
+	if pending != nil {
+		pending.close() // Adds paths to the backends, so must be done first.
+	}
+	if follow != nil {
+		follow.close()
+	}
+	if parents != nil {
+		parents.close()
+	}
+	if p != nil {
+		p.Close() // Must be done first, as b.Close() closes the channels.
+	}
+
+	err := w.b.Close()
+	if err == nil && w.forwardDone != nil {
+		<-w.forwardDone
+	}
+	if err == nil && w.handler != nil {
+		<-w.handler.done
+	}
+	if err == nil && save {
+		err = w.state.save(w.resync)
+	}
+	if w.resync != nil {
+		w.resync.close()
+	}
+	return err
+}
+
+// Next blocks until the next event or error is available, and returns it.
+//
+// Errors read from the Errors channel are returned as-is; these are usually
+// not fatal and the Watcher can still be used. Returns [ErrClosed] once the
+// Watcher is closed and all events have been read, or ctx.Err() if the
+// context is cancelled.
+//
+// Next reads from the Events and Errors channels, so shouldn't be mixed with
+// reading from those channels directly.
+func (w *Watcher) Next(ctx context.Context) (Event, error) {
+	events, errs := w.Events, w.Errors
+	for events != nil || errs != nil {
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			return e, nil
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			return Event{}, err
+		}
+	}
+	return Event{}, ErrClosed
+}
+
+// Run calls handler for every event or error until the context is cancelled,
+// the Watcher is closed, or the handler returns an error. The handler is called
+// with either an event and a nil error, or with an error read from the Errors
+// channel.
+//
+// The Watcher is closed when Run returns. The error is the one returned by the
+// handler, ctx.Err() if the context was cancelled, or nil if the Watcher was
+// closed with [Watcher.Close].
+//
+// This is useful with e.g. errgroup:
+//
+//	g, ctx := errgroup.WithContext(ctx)
+//	g.Go(func() error {
+//		return w.Run(ctx, func(e fsnotify.Event, err error) error {
+//			if err != nil {
+//				log.Print(err)
+//				return nil
+//			}
+//			return handle(e)
+//		})
+//	})
+func (w *Watcher) Run(ctx context.Context, handler func(Event, error) error) error {
+	defer w.Close()
+	for {
+		e, err := w.Next(ctx)
+		switch {
+		case errors.Is(err, ErrClosed):
+			return nil
+		case err != nil && ctx.Err() != nil:
+			return ctx.Err()
+		}
+		if err := handler(e, err); err != nil {
+			return err
+		}
+	}
+}
 
 // WatchList returns all paths explicitly added with [Watcher.Add] (and are not
 // yet removed).
 //
+// Recursive watches are returned with the "/..." suffix; subdirectories that
+// are watched as part of a recursive watch are not included.
+//
 // The order is undefined, and may differ per call. Returns nil if
 // [Watcher.Close] was called.
-func (w *Watcher) WatchList() []string { return w.b.WatchList() }
+func (w *Watcher) WatchList() []string {
+	w.pollMu.Lock()
+	p, pending, follow, parents := w.poll, w.pending, w.follow, w.parents
+	w.pollMu.Unlock()
+	l := w.b.WatchList()
+	if parents != nil && l != nil {
+		l = parents.filterList(w.b, l)
+	}
+	if p != nil && l != nil {
+		pl := p.WatchList()
+		if parents != nil {
+			pl = parents.filterList(p, pl)
+		}
+		l = append(l, pl...)
+	}
+	if pending != nil && l != nil {
+		l = append(l, pending.list()...)
+	}
+	if follow != nil && l != nil {
+		l = append(l, follow.list()...)
+	}
+	return l
+}
+
+// WatchCount returns the number of watches in use. What a "watch" is differs
+// per backend:
+//
+//   - inotify: watch descriptors; one for every directory in recursive watches.
+//   - fanotify: marks.
+//   - kqueue: file descriptors; one for every file in watched directories.
+//   - windows: directory handles.
+//   - fen: paths added with Add().
+//
+// Paths added with [WithPolling] don't use watches and aren't counted. The
+// parent directories watched for [WithNonExistent] and [WithFollowName] are
+// counted, and also count towards the [WithMaxWatches] limit.
+func (w *Watcher) WatchCount() int {
+	n, _ := w.b.watchCount()
+	return n
+}
+
+// Stats has counters to monitor a Watcher; see [Watcher.Stats].
+//
+// All counters except Watches and UserWatches only ever increase, and are
+// never reset.
+type Stats struct {
+	// Number of watches in use, as reported by [Watcher.WatchCount].
+	Watches int
+
+	// Number of watches for paths added with [Watcher.Add]. The other watches
+	// are for subdirectories of recursive watches, files in watched
+	// directories (kqueue), symlinks that are followed, and the parent
+	// directories of paths added with [WithNonExistent] and [WithFollowName].
+	UserWatches int
+
+	// Events read from the kernel, before any processing; for paths added
+	// with [WithPolling] these are the changes found by scanning.
+	//
+	// This is not the same as the number of events sent: one kernel event may
+	// result in several Events, or none at all.
+	EventsRead uint64
+
+	// Events sent on the Events channel.
+	EventsSent uint64
+
+	// Events not sent because they were filtered out by [WithOps],
+	// [WithInclude], [WithExclude], or [WithGitignore]. This includes events
+	// for the parent directories watched for [WithNonExistent] and
+	// [WithFollowName].
+	EventsFiltered uint64
+
+	// Number of times the kernel queue overflowed and events were lost; an
+	// [ErrEventOverflow] is sent for every overflow.
+	Overflows uint64
+
+	// Errors sent on the Errors channel, including overflows.
+	Errors uint64
+
+	// Bytes read from the inotify, fanotify, or ReadDirectoryChangesW buffer;
+	// always 0 for the other backends.
+	BytesRead uint64
+}
+
+// Stats gets counters for the Watcher, for example to alert on a large number
+// of overflows, or on the number of watches increasing over time.
+//
+// Stats includes paths added with [WithPolling], [WithNonExistent], and
+// [WithFollowName].
+func (w *Watcher) Stats() Stats {
+	var s Stats
+	s.Watches, s.UserWatches = w.b.watchCount()
+	w.b.counters().add(&s)
+
+	w.pollMu.Lock()
+	p, pending, follow, parents := w.poll, w.pending, w.follow, w.parents
+	w.pollMu.Unlock()
+	if parents != nil {
+		s.UserWatches -= parents.count(w.b)
+	}
+	if p != nil {
+		p.counters().add(&s)
+	}
+	if pending != nil {
+		pending.out.counters().add(&s)
+	}
+	if follow != nil {
+		follow.out.counters().add(&s)
+	}
+
+	// The backends send to forward(), which may drop or merge events.
+	if w.events != w.Events {
+		s.EventsSent, s.Errors = w.stats.sent.Load(), w.stats.errors.Load()
+	}
+	return s
+}
 
 // Supports reports if all the listed operations are supported by this platform.
 //
 // Create, Write, Remove, Rename, and Chmod are always supported. It can only
 // return false for an Op starting with Unportable.
-func (w *Watcher) xSupports(op Op) bool { return w.b.xSupports(op) }
+//
+// Operations are supported if [Watcher.AddWith] with [WithOps] doesn't return
+// [ErrUnsupported] for them.
+func (w *Watcher) Supports(op Op) bool { return w.b.Supports(op) }
 
 func (o Op) String() string {
 	var b strings.Builder
@@ -331,18 +1036,24 @@ func (o Op) String() string {
 	if o.Has(Write) {
 		b.WriteString("|WRITE")
 	}
-	if o.Has(xUnportableOpen) {
+	if o.Has(UnportableOpen) {
 		b.WriteString("|OPEN")
 	}
-	if o.Has(xUnportableRead) {
+	if o.Has(UnportableRead) {
 		b.WriteString("|READ")
 	}
-	if o.Has(xUnportableCloseWrite) {
+	if o.Has(UnportableCloseWrite) {
 		b.WriteString("|CLOSE_WRITE")
 	}
-	if o.Has(xUnportableCloseRead) {
+	if o.Has(UnportableCloseRead) {
 		b.WriteString("|CLOSE_READ")
 	}
+	if o.Has(UnportableUnwatch) {
+		b.WriteString("|UNWATCH")
+	}
+	if o.Has(UnportableUnmount) {
+		b.WriteString("|UNMOUNT")
+	}
 	if o.Has(Rename) {
 		b.WriteString("|RENAME")
 	}
@@ -363,8 +1074,8 @@ func (e Event) Has(op Op) bool { return e.Op.Has(op) }
 
 // String returns a string representation of the event with their path.
 func (e Event) String() string {
-	if e.renamedFrom != "" {
-		return fmt.Sprintf("%-13s %q ← %q", e.Op.String(), e.Name, e.renamedFrom)
+	if e.RenamedFrom != "" {
+		return fmt.Sprintf("%-13s %q ← %q", e.Op.String(), e.Name, e.RenamedFrom)
 	}
 	return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
 }
@@ -376,14 +1087,55 @@ type (
 		Remove(string) error
 		WatchList() []string
 		Close() error
-		xSupports(Op) bool
+		Supports(Op) bool
+		watchCount() (total, user int)
+		counters() *statCounters
+		setOpts(watcherOpts)
 	}
 	addOpt   func(opt *withOpts)
 	withOpts struct {
-		bufsize    int
-		op         Op
-		sendCreate bool
+		bufsize      int
+		op           Op
+		pollInterval time.Duration
+		mark         markKind
+		include      []string
+		exclude      []string
+		gitignore    bool
+		stat         bool
+		nonExistent  bool
+		followName   bool
+		existing     bool
+		saved        snapshot // From WithStateFile(), if this path was watched before.
+		symlinks     symlinkMode
+		parent       *parentWatches // Watched as a parent directory; see asParent().
+		parentOnly   bool           // Parent directory that the user doesn't watch.
+	}
+
+	watcherOpt  func(opt *watcherOpts)
+	watcherOpts struct {
+		bufsize      uint
+		pollInterval time.Duration
+		fanotify     bool
+		resync       bool
+		debounce     time.Duration
+		debounceMax  time.Duration
+		maxWatches   int
+		logger       *slog.Logger
+		stateFile    string
+		renameWindow time.Duration
+		onEvent      func(Event)
+		onError      func(error)
+		workers      int
 	}
+
+	// What to mark with fanotify.
+	markKind uint8
+)
+
+const (
+	markInode markKind = iota
+	markMount
+	markFilesystem
 )
 
 var debug = func() bool {
@@ -431,29 +1183,444 @@ func WithBufferSize(bytes int) addOpt {
 //
 // This can also be used to add unportable operations not supported by all
 // platforms; unportable operations all start with "Unportable":
-// [UnportableOpen], [UnportableRead], [UnportableCloseWrite], and
-// [UnportableCloseRead].
+// [UnportableOpen], [UnportableRead], [UnportableCloseWrite],
+// [UnportableCloseRead], [UnportableUnwatch], and [UnportableUnmount].
+//
+// AddWith returns [ErrUnsupported] when using an unportable operation that's
+// not supported. Use [Watcher.Supports] to check for support.
 //
-// AddWith returns an error when using an unportable operation that's not
-// supported. Use [Watcher.Support] to check for support.
-func withOps(op Op) addOpt {
+// Events for files inside a watched directory use the operations of that
+// directory. Adding the same path more than once with different operations
+// combines them on Linux and Windows, but the last call wins on other
+// platforms.
+func WithOps(op Op) addOpt {
 	return func(opt *withOpts) { opt.op = op }
 }
 
-// "Internal" option for recursive watches on inotify.
-func withCreate() addOpt {
-	return func(opt *withOpts) { opt.sendCreate = true }
+// WithPolling polls the path for changes every interval, instead of using the
+// platform's native backend. This works on all filesystems, including network
+// filesystems (NFS, SMB, FUSE, etc.) where the native backends generally don't
+// send events. The default interval of one second is used if interval is 0.
+//
+// Polling uses a lot more resources than the native backends, especially for
+// large directories, so it's best used only for paths that need it.
+//
+// Polling compares the output of stat and readdir between two scans:
+//
+//   - Create and Remove are sent for paths that appeared or disappeared.
+//   - Write is sent when the size or modification time changed, and Chmod if
+//     the mode changed.
+//   - Renames are detected by the inode number; a Rename event is sent with a
+//     Create event with [Event.RenamedFrom] set. On platforms without inode
+//     numbers (Windows, plan9) these are sent as Remove and Create.
+//
+// Changes in between two scans are merged or lost; for example a file that's
+// created and removed again within the interval won't send any events.
+// Unportable operations are not supported.
+func WithPolling(interval time.Duration) addOpt {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return func(opt *withOpts) { opt.pollInterval = interval }
 }
 
-var enableRecurse = false
+// WithPollingBackend uses polling for all paths, instead of the platform's
+// native backend; see [WithPolling] for details. The interval can be
+// overridden per path by [WithPolling], and the default of one second is used
+// if interval is 0.
+func WithPollingBackend(interval time.Duration) watcherOpt {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return func(opt *watcherOpts) { opt.pollInterval = interval }
+}
+
+// WithFanotify uses the fanotify backend on Linux, instead of inotify.
+// [NewWatcherWith] returns [ErrUnsupported] on other platforms, and an error if
+// the kernel doesn't support it (Linux 5.9 or newer is needed).
+//
+// Unlike inotify, fanotify can watch an entire mount or filesystem with a
+// single mark ([WithMountMark] and [WithFilesystemMark]), which doesn't run in
+// to the fs.inotify.max_user_watches limit for large directory trees. Recursive
+// watches with Add("dir/...") use a filesystem mark, and only send events for
+// paths inside the directory.
+//
+// Mount and filesystem marks (and thus recursive watches) need the
+// CAP_SYS_ADMIN capability, and CAP_DAC_READ_SEARCH to look up the paths of
+// events. Marks on individual files and directories work without privileges.
+//
+// The kernel reports a handle for the directory rather than a path, which is
+// looked up when the event is read. The path may already have been renamed by
+// then, in which case the new path is used.
+//
+// [Event.RenamedFrom] is set on Linux 5.17 and newer.
+func WithFanotify() watcherOpt {
+	return func(opt *watcherOpts) { opt.fanotify = true }
+}
+
+// WithMountMark watches the entire mount the path is on, rather than just the
+// path. Event.Name is an absolute path for all events from this watch.
+//
+// Mount marks can only send [Write] and the unportable events; use
+// [WithFilesystemMark] to also get [Create], [Remove], [Rename], and [Chmod].
+//
+// This only works with [WithFanotify]; AddWith returns [ErrUnsupported] for
+// other backends.
+func WithMountMark() addOpt {
+	return func(opt *withOpts) { opt.mark = markMount }
+}
+
+// WithFilesystemMark watches the entire filesystem the path is on, rather than
+// just the path. Event.Name is an absolute path for all events from this
+// watch.
+//
+// This only works with [WithFanotify]; AddWith returns [ErrUnsupported] for
+// other backends.
+func WithFilesystemMark() addOpt {
+	return func(opt *withOpts) { opt.mark = markFilesystem }
+}
+
+// WithInclude only sends events for paths matching at least one of the
+// patterns. It can be given more than once to add more patterns.
+//
+// Directories are still watched for recursive watches if they don't match, so
+// that e.g. WithInclude("*.go") sends events for Go files in all
+// subdirectories. See [WithExclude] for the pattern syntax.
+func WithInclude(patterns ...string) addOpt {
+	return func(opt *withOpts) { opt.include = append(opt.include, patterns...) }
+}
+
+// WithExclude doesn't send events for paths matching any of the patterns. It
+// can be given more than once to add more patterns. Exclude patterns take
+// precedence over [WithInclude].
+//
+// Patterns are matched against the path relative to the watched path, with "/"
+// as the separator on all platforms:
+//
+//   - Patterns without a "/" match the file or directory name at any depth;
+//     for example ".git" or "*.swp".
+//   - Patterns with a "/" match the full relative path; for example
+//     "build/out" or "docs/*.html". A leading "/" is ignored.
+//   - "**" matches zero or more directories; for example "src/**/testdata".
+//     A trailing "/**" matches everything in the directory, but not the
+//     directory itself.
+//   - Patterns ending with "/" only match directories; for example "tmp/".
+//   - The syntax for everything else is the same as [path.Match].
+//
+// Everything in a matching directory also matches. Recursive watches don't
+// watch excluded directories at all; this saves a watch for every directory
+// on Linux.
+//
+// Events for the watched path itself are always sent. If a path is covered by
+// more than one watch the patterns of the closest watch are used. For mount
+// and filesystem marks the patterns are only used for paths inside the added
+// path.
+//
+// AddWith returns an error if a pattern is malformed.
+func WithExclude(patterns ...string) addOpt {
+	return func(opt *withOpts) { opt.exclude = append(opt.exclude, patterns...) }
+}
+
+// WithGitignore doesn't send events for paths that git would ignore, and
+// recursive watches don't watch ignored directories. It can be combined with
+// [WithInclude] and [WithExclude].
+//
+// Rules are read from the .gitignore and .ignore files in the watched
+// directory and all subdirectories, .git/info/exclude in the watched directory,
+// and the global excludes file (core.excludesFile in the git config, or
+// $XDG_CONFIG_HOME/git/ignore). Rules in .ignore files take precedence over
+// .gitignore files in the same directory. The .git directory is always
+// ignored. Ignore files outside the watched directory aren't used.
+//
+// Ignore files are read again after an event for them, so the operations set
+// with [WithOps] should include [Create], [Write], and [Remove] to pick up
+// changes. The global excludes file and .git/info/exclude are read again if
+// their modification time changed, which is checked once a second.
+// Directories that are no longer ignored after a change aren't watched until
+// they're created again.
+func WithGitignore() addOpt {
+	return func(opt *withOpts) { opt.gitignore = true }
+}
+
+// WithStat sets [Event.Stat] to the result of lstat on the path, right before
+// the event is sent. This saves a separate stat call, but does add a syscall
+// for every event; it's best used with [WithOps] to only get the events you
+// need.
+//
+// [Event.IsDir] is also set from the lstat result, which is useful on Windows
+// where it's not otherwise known.
+func WithStat() addOpt {
+	return func(opt *withOpts) { opt.stat = true }
+}
+
+// WithNonExistent allows adding a path that doesn't exist yet.
+//
+// The nearest parent directory that exists is watched instead, and the watch
+// is moved down as directories are created. A [Create] event is sent once the
+// path exists, after which it's watched as if it was added when it existed
+// (e.g. the watch is removed if it's deleted). No events are sent for the
+// parent directories, unless they're added with [Watcher.Add] as well. The
+// parent directory uses a watch, which is counted in [Watcher.WatchCount] and
+// for [WithMaxWatches].
+//
+// The path is included in [Watcher.WatchList] while it's waiting, and can be
+// removed with [Watcher.Remove]. The option has no effect if the path already
+// exists.
+func WithNonExistent() addOpt {
+	return func(opt *withOpts) { opt.nonExistent = true }
+}
+
+// WithFollowName watches a file by its name, rather than the file itself.
+//
+// Many programs (especially editors) save files by writing to a temporary file
+// and renaming it over the original, or by removing the file and creating it
+// again. A regular watch is lost when that happens, as it's for the original
+// file. With WithFollowName the parent directory is watched instead, and only
+// events for the path are sent:
+//
+//   - A file that's replaced by a rename, or removed or renamed and created
+//     again shortly after, is sent as a single [Write].
+//   - [Remove] and [Rename] are delayed by a short while (100ms) to see if the
+//     file is created again, and sent if it isn't.
+//   - [Create] is sent if the file is created after a Remove or Rename was
+//     sent.
+//
+// The watch stays until it's removed with [Watcher.Remove], or until the parent
+// directory is removed. The file doesn't need to exist, but the parent
+// directory does; use [WithNonExistent] as well if the parent may not exist.
+// The parent directory uses a watch, which is counted in [Watcher.WatchCount]
+// and for [WithMaxWatches].
+//
+// This can't be used with recursive watches.
+func WithFollowName() addOpt {
+	return func(opt *withOpts) { opt.followName = true }
+}
+
+// WithExisting sends a [Create] event for every file and directory that exists
+// when the path is added, so that the initial state and all changes after it
+// can be read from the Events channel, without the race of listing the
+// directory separately: anything created after the watch is added and before
+// the directory is listed would otherwise be missed or reported twice.
+//
+// The directory is listed after the watch is set up, and the Create events are
+// sent before any events that happen after listing it. Changes in between may
+// still be sent as well: a path may be reported with a Create from the listing
+// and another Create from the watch, and a Remove or Rename may be sent for a
+// path that wasn't reported.
+//
+// For recursive watches everything in all subdirectories is sent, with parent
+// directories before the paths in them. For files a Create is sent for the
+// file itself. Paths excluded with [WithInclude], [WithExclude], or
+// [WithGitignore] aren't sent, and neither is anything if [WithOps] doesn't
+// include Create.
+//
+// This is supported by the inotify and fanotify backends, and for paths added
+// with [WithPolling]; [ErrUnsupported] is returned on other platforms. It
+// can't be used with [WithFollowName].
+func WithExisting() addOpt {
+	return func(opt *withOpts) { opt.existing = true }
+}
+
+// WithSymlinks sets if symlinks are followed. This is only supported by the
+// inotify backend; [ErrUnsupported] is returned on other platforms.
+//
+// By default a symlink is resolved once when it's added, and the target is
+// watched. Symlinks in directories added with a recursive watch aren't
+// followed.
+//
+// If follow is true the target is watched and events are sent with the path
+// of the link (as with the default), and the link itself is also watched: if
+// it's replaced to point somewhere else, the new target is watched and a
+// [Create] event is sent for the link. For recursive watches symlinks to
+// directories are followed as if they were directories. A directory that's
+// already watched through another path (e.g. a symlink loop) isn't watched
+// again, and events for it are only sent with the first path.
+//
+// If follow is false symlinks are never followed, and the link itself is
+// watched (IN_DONT_FOLLOW). Only changes to the link are sent, not changes
+// to the target.
+func WithSymlinks(follow bool) addOpt {
+	return func(opt *withOpts) {
+		opt.symlinks = symlinkNoFollow
+		if follow {
+			opt.symlinks = symlinkFollow
+		}
+	}
+}
+
+// WithResyncOnOverflow rescans all watched paths after an [ErrEventOverflow],
+// and sends [Create], [Remove], [Rename], [Write], and [Chmod] events for
+// everything that changed since the last event. ErrEventOverflow is still sent
+// on the Errors channel, before the events from the rescan.
+//
+// This keeps a snapshot of all watched paths in memory, which is updated with
+// an lstat for every event. The events from the rescan are the same as
+// described in [WithPolling]; changes may be merged, and a file that was
+// created and removed again while events were lost won't show up at all.
+func WithResyncOnOverflow() watcherOpt {
+	return func(opt *watcherOpts) { opt.resync = true }
+}
+
+// WithStateFile keeps the state of all watched paths in file, so that changes
+// made while the program wasn't running are sent when the paths are added
+// again.
+//
+// The file has the size, mtime, mode, and inode of every watched file and
+// directory; it's read by NewWatcherWith and written by [Watcher.Close]. When
+// a path is added that's in the file, [Create], [Write], [Remove], [Rename],
+// and [Chmod] events are sent for everything that changed, before any events
+// for changes after it was added. The events are the same as described in
+// [WithPolling]: changes may be merged, and a file that was created and
+// removed again won't show up at all. Nothing is sent the first time a path is
+// added; use [WithExisting] to get a Create for everything that exists.
+//
+// The state is kept up to date from the events that are sent, the same way as
+// [WithResyncOnOverflow], which is also enabled. The state is only written on
+// Close: if the program exits without calling Close the events since the
+// previous Close are sent again. Paths removed with [Watcher.Remove] are
+// removed from the file, and paths that are in the file but not added are
+// kept.
+//
+// This is supported by the inotify and fanotify backends, and with
+// [WithPollingBackend]; [ErrUnsupported] is returned on other platforms.
+func WithStateFile(file string) watcherOpt {
+	return func(opt *watcherOpts) { opt.stateFile = file }
+}
+
+// WithDebounce merges events for the same path, until no new events for that
+// path have been seen for the quiet period. If maxDelay is more than 0 the
+// event is sent at most maxDelay after the first event, even if new events
+// keep coming in. Debouncing is disabled if quiet is 0.
+//
+// The operations of all merged events are combined; for example a file that's
+// created and written to is sent as a single event with both [Create] and
+// [Write], and a file that's created and removed again has both [Create] and
+// [Remove]. [Event.RenamedFrom] is set if any of the merged events had it.
+//
+// Every path is sent once it's due, so a path that's seen later but stops
+// changing sooner is sent before a path that was seen earlier but keeps
+// changing. Events that are due at the same time are sent in the order they
+// were first seen.
+//
+// This is useful to wait for a program to finish writing a file; for example
+// compiling a large Go program may generate hundreds of Write events.
+//
+// Pending events are sent when [Watcher.Close] is called, provided something
+// is still reading from the Events channel: they're dropped if it's not read
+// within the quiet period or a second, whichever is shorter.
+func WithDebounce(quiet, maxDelay time.Duration) watcherOpt {
+	return func(opt *watcherOpts) { opt.debounce, opt.debounceMax = quiet, maxDelay }
+}
+
+// WithRenamePairing holds [Rename] events for up to window, to see if a
+// [Create] with [Event.RenamedFrom] set to the same path follows; pairing is
+// disabled if window is 0.
+//
+// If it does, the Rename is sent followed by the Create as usual. If it
+// doesn't, the path was moved to somewhere that's not watched and the Rename
+// is sent with Remove set as well (Remove|Rename), so that it can be treated
+// as a Remove. A path that's moved in from somewhere that's not watched is
+// sent as a Create without RenamedFrom.
+//
+// Renames are paired for all paths in the Watcher, including between separate
+// watches: moving "dir1/file" to "dir2/file" with both directories added is
+// sent as a Rename for dir1/file and a Create for dir2/file, rather than as
+// Remove|Rename. Paths added with [WithPolling] are only paired with other
+// paths added with WithPolling. The Create needs to be sent for it to be
+// paired, so a path renamed to a name excluded with [WithOps], [WithInclude],
+// [WithExclude], or [WithGitignore] is sent as Remove|Rename.
+//
+// All events after a Rename are held until it's paired or the window has
+// passed, so that the order in which events are sent doesn't change. The new
+// name is almost always known right away, so a short window (e.g. 50ms)
+// should be enough. Events that are held when [Watcher.Close] is called are
+// sent without waiting for a pair.
+//
+// Only inotify, fanotify, and polling report the new name of renamed paths;
+// with the other backends every Rename is sent as Remove|Rename.
+func WithRenamePairing(window time.Duration) watcherOpt {
+	return func(opt *watcherOpts) { opt.renameWindow = window }
+}
+
+// WithMaxWatches sets the maximum number of watches the Watcher can use, as
+// reported by [Watcher.WatchCount]. Adding a watch beyond that returns
+// [ErrWatchLimit]; for watches that are added automatically, such as new
+// subdirectories in recursive watches, the error is sent on the Errors
+// channel. There is no maximum if n is 0.
+//
+// This is useful to stop a single Watcher from using all of the system's
+// fs.inotify.max_user_watches limit, which is shared by all programs running
+// as the same user.
+func WithMaxWatches(n int) watcherOpt {
+	return func(opt *watcherOpts) { opt.maxWatches = n }
+}
+
+// WithLogger logs debug information to l: events as they're read from the
+// kernel (with the raw masks and cookies), watches being added and removed, and
+// errors sent on the Errors channel. Everything is logged at the debug level.
+//
+// This is the same information that's printed with FSNOTIFY_DEBUG=1, which
+// still works if this is set.
+func WithLogger(l *slog.Logger) watcherOpt {
+	return func(opt *watcherOpts) { opt.logger = l }
+}
+
+// WithHandler calls onEvent for every event and onError for every error,
+// instead of sending them on the Events and Errors channels. Either may be nil,
+// in which case those events or errors are dropped. This is useful when a
+// callback fits better than a channel, for example for plugins or when calling
+// from C.
+//
+// The handlers are called from a single goroutine the Watcher starts, one
+// after the other, in the same order as they would be sent on the channels.
+// No new events are read while a handler is running, so a handler that blocks
+// stops all events: the kernel keeps queueing events until its queue is full,
+// after which they're lost and [ErrEventOverflow] is sent to onError (with
+// inotify, fanotify, and Windows; kqueue and FEN don't report overflows).
+// Handlers should do as little work as possible, or hand it off to another
+// goroutine. Use [WithHandlerWorkers] to call onEvent from more than one
+// goroutine.
+//
+// [Watcher.Close] stops reading new events and waits for running handlers to
+// return, after which no handlers are called. It must not be called from a
+// handler, as it would wait for itself. The Events and Errors channels
+// shouldn't be read, and [Watcher.Next], [Watcher.Run], and [Watcher.Subscribe]
+// can't be used.
+func WithHandler(onEvent func(Event), onError func(error)) watcherOpt {
+	return func(opt *watcherOpts) { opt.onEvent, opt.onError = onEvent, onError }
+}
+
+// WithHandlerWorkers calls the onEvent handler from [WithHandler] from n
+// goroutines, so that a slow handler doesn't block events for other paths.
+// This does nothing without WithHandler, or if n is 1 or less.
+//
+// Every path is always handled by the same worker, so events for the same path
+// are handled in order, but events for different paths may be handled in any
+// order and at the same time. Notably, the Rename for the old path and Create
+// for the new path are usually handled by different workers.
+//
+// Every worker has a queue the size of the Events channel buffer (see
+// [NewBufferedWatcher]); once the queue for a path is full, reading new events
+// blocks until the worker for that path has handled one. onError is still
+// called from a single goroutine, which may be at the same time as onEvent.
+func WithHandlerWorkers(n int) watcherOpt {
+	return func(opt *watcherOpts) { opt.workers = n }
+}
+
+func getWatcherOptions(opts ...watcherOpt) watcherOpts {
+	with := watcherOpts{bufsize: uint(defaultBufferSize)}
+	for _, o := range opts {
+		if o != nil {
+			o(&with)
+		}
+	}
+	return with
+}
 
 // Check if this path is recursive (ends with "/..." or "\..."), and return the
 // path with the /... stripped.
 func recursivePath(path string) (string, bool) {
 	path = filepath.Clean(path)
-	if !enableRecurse { // Only enabled in tests for now.
-		return path, false
-	}
 	if filepath.Base(path) == "..." {
 		return filepath.Dir(path), true
 	}
@@ -475,4 +1642,15 @@ const (
 	// Part of recursive watch; as the top-level path added by the user or an
 	// "internal" watch.
 	flagRecurse = watchFlag(0x02)
+	// Follow symlinks; WithSymlinks(true).
+	flagFollow = watchFlag(0x04)
+)
+
+// How to handle symlinks; WithSymlinks().
+type symlinkMode uint8
+
+const (
+	symlinkDefault symlinkMode = iota
+	symlinkFollow
+	symlinkNoFollow
 )
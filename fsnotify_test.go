@@ -1,9 +1,12 @@
 package fsnotify
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -19,10 +22,6 @@ import (
 	"github.com/fsnotify/fsnotify/internal"
 )
 
-func init() {
-	enableRecurse = true
-}
-
 func TestScript(t *testing.T) {
 	err := filepath.Walk("./testdata", func(path string, info fs.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
@@ -363,6 +362,40 @@ func TestClose(t *testing.T) {
 		chanClosed(t, w.w)
 	})
 
+	// Closing a Watcher shouldn't affect other Watchers, even if they get the
+	// same fd number as the one that was closed.
+	t.Run("other watcher", func(t *testing.T) {
+		t.Parallel()
+		supportsRecurse(t)
+
+		tmp1 := t.TempDir()
+		for i := range 100 {
+			mkdir(t, tmp1, fmt.Sprintf("dir%d", i), noWait)
+		}
+		for range 20 {
+			tmp2 := t.TempDir()
+			w1 := newWatcher(t, join(tmp1, "..."))
+			closed := make(chan error)
+			go func() { closed <- w1.Close() }()
+			for range w1.Events { // Closed once the fd is closed.
+			}
+			w2 := newWatcher(t, tmp2)
+			if err := <-closed; err != nil {
+				t.Fatal(err)
+			}
+
+			touch(t, tmp2, "file")
+			select {
+			case <-w2.Events:
+			case err := <-w2.Errors:
+				t.Fatal(err)
+			case <-time.After(time.Second):
+				t.Fatal("no event after closing another Watcher")
+			}
+			w2.Close()
+		}
+	})
+
 	t.Run("error after closed", func(t *testing.T) {
 		t.Parallel()
 
@@ -556,6 +589,33 @@ func TestAdd(t *testing.T) {
 		`))
 	})
 
+	t.Run("recursive", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "sub", "dir")
+		touch(t, tmp, "file")
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		err := w.Add(join(tmp, "..."))
+		_, polling := w.b.(*polling)
+		switch {
+		case runtime.GOOS == "windows" || runtime.GOOS == "linux" || polling:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Add(join(tmp, "file", "...")); err == nil {
+				t.Fatal("no error when adding a file recursively")
+			}
+		default:
+			if !errors.Is(err, ErrUnsupported) {
+				t.Fatalf("wrong error: %#v", err)
+			}
+		}
+	})
+
 	t.Run("not reading events", func(t *testing.T) {
 		t.Parallel()
 
@@ -831,6 +891,31 @@ func TestRemove(t *testing.T) {
 	})
 }
 
+func TestSupports(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+
+	if !w.Supports(Create | Write | Remove | Rename | Chmod) {
+		t.Error("portable operations not supported")
+	}
+
+	for _, op := range []Op{UnportableOpen, UnportableRead, UnportableCloseWrite, UnportableCloseRead} {
+		err := w.AddWith(tmp, WithOps(op))
+		if w.Supports(op) {
+			if err != nil {
+				t.Errorf("%s: %s", op, err)
+			}
+		} else {
+			if !errors.Is(err, ErrUnsupported) {
+				t.Errorf("%s: wrong error: %#v", op, err)
+			}
+		}
+	}
+}
+
 func TestEventString(t *testing.T) {
 	tests := []struct {
 		in   Event
@@ -847,6 +932,8 @@ func TestEventString(t *testing.T) {
 			`REMOVE        "/file"`},
 		{Event{Name: "/file", Op: Write | Chmod},
 			`WRITE|CHMOD   "/file"`},
+		{Event{Name: "/rename", Op: Create, RenamedFrom: "/file"},
+			`CREATE        "/rename" ← "/file"`},
 	}
 
 	for _, tt := range tests {
@@ -1203,3 +1290,1342 @@ func TestNewWatcher(t *testing.T) {
 		t.Errorf("cap of NewWatcher() is not %d but %d", 42, c)
 	}
 }
+
+func TestResyncOnOverflow(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	touch(t, tmp, "keep")
+
+	w, err := NewWatcherWith(WithResyncOnOverflow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+
+	var (
+		have Events
+		errs []error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				have = append(have, e)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				errs = append(errs, err)
+			}
+		}
+	}()
+
+	touch(t, tmp, "new")
+	waitForEvents()
+
+	// Remove from the backend so it won't send events, and then pretend we got
+	// an overflow.
+	if err := w.b.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	echoAppend(t, "data", tmp, "file")
+	rm(t, tmp, "keep")
+	touch(t, tmp, "other")
+	w.errors <- ErrEventOverflow
+	waitForEvents()
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if len(errs) != 1 || !errors.Is(errs[0], ErrEventOverflow) {
+		t.Errorf("wrong errors: %v", errs)
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /new
+		write   /file
+		remove  /keep
+		create  /other
+	`))
+}
+
+func TestDebounce(t *testing.T) {
+	t.Parallel()
+
+	newDebounce := func(t *testing.T, quiet, maxDelay time.Duration, tmp string) *eventCollector {
+		t.Helper()
+		w, err := NewWatcherWith(WithDebounce(quiet, maxDelay))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddWith(tmp, WithOps(Create|Write|Remove)); err != nil {
+			t.Fatal(err)
+		}
+		c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+		c.collect(t)
+		return c
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newDebounce(t, 200*time.Millisecond, 0, tmp)
+
+		touch(t, tmp, "file")
+		for i := 0; i < 3; i++ {
+			echoAppend(t, "data", tmp, "file")
+		}
+		touch(t, tmp, "other")
+		rm(t, tmp, "other")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create|write   /file
+			create|remove  /other
+		`))
+	})
+
+	t.Run("max delay", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newDebounce(t, 300*time.Millisecond, 200*time.Millisecond, tmp)
+
+		for i := 0; i < 10; i++ {
+			echoAppend(t, "data", tmp, "file", noWait)
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		// Should be sent at least once while we were still writing.
+		have := w.stop(t)
+		if len(have) < 2 {
+			t.Errorf("want at least 2 events, have:\n%s", have)
+		}
+		for _, e := range have {
+			if e.Op != Write {
+				t.Errorf("wrong event: %s", e)
+			}
+		}
+	})
+
+	t.Run("flush on close", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newDebounce(t, time.Hour, 0, tmp)
+
+		touch(t, tmp, "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create  /file
+		`))
+	})
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+
+	t.Run("events", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+		defer w.Close()
+
+		touch(t, tmp, "file")
+		e, err := w.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Name != join(tmp, "file") || !e.Has(Create) {
+			t.Errorf("wrong event: %s", e)
+		}
+
+		go func() { w.errors <- ErrEventOverflow }()
+		if _, err := w.Next(context.Background()); !errors.Is(err, ErrEventOverflow) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		defer w.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := w.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		w.Close()
+		if _, err := w.Next(context.Background()); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	t.Run("handler error", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+
+		stop := errors.New("stop")
+		done := make(chan error)
+		go func() {
+			done <- w.Run(context.Background(), func(e Event, err error) error {
+				if err != nil {
+					return err
+				}
+				if e.Name == join(tmp, "stop") {
+					return stop
+				}
+				return nil
+			})
+		}()
+
+		touch(t, tmp, "file")
+		touch(t, tmp, "stop")
+		if err := <-done; err != stop {
+			t.Errorf("wrong error: %v", err)
+		}
+		if l := w.WatchList(); l != nil {
+			t.Errorf("not closed; WatchList: %q", l)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- w.Run(ctx, func(Event, error) error { return nil })
+		}()
+
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if l := w.WatchList(); l != nil {
+			t.Errorf("not closed; WatchList: %q", l)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		done := make(chan error)
+		go func() {
+			done <- w.Run(context.Background(), func(Event, error) error { return nil })
+		}()
+
+		w.Close()
+		if err := <-done; err != nil {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestPathFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		include, exclude []string
+		path             string
+		isDir            bool
+		want             bool
+	}{
+		{nil, []string{".git"}, ".git", true, true},
+		{nil, []string{".git"}, "sub/.git/objects/file", false, true},
+		{nil, []string{".git"}, ".github", true, false},
+		{nil, []string{"*.swp"}, "a/b/.file.swp", false, true},
+		{nil, []string{"build/out"}, "build/out/file", false, true},
+		{nil, []string{"build/out"}, "sub/build/out", true, false},
+		{nil, []string{"/build"}, "build", true, true},
+		{nil, []string{"src/**/testdata"}, "src/testdata", true, true},
+		{nil, []string{"src/**/testdata"}, "src/a/b/testdata/file", false, true},
+		{nil, []string{"**/*.tmp"}, "a/b/c.tmp", false, true},
+		{nil, []string{"tmp/"}, "tmp", true, true},
+		{nil, []string{"tmp/"}, "tmp", false, false},
+		{nil, []string{"tmp/"}, "tmp/file", false, true},
+
+		{[]string{"*.go"}, nil, "a/file.go", false, false},
+		{[]string{"*.go"}, nil, "a/file.txt", false, true},
+		{[]string{"*.go"}, nil, "a", true, true},
+		{[]string{"docs"}, nil, "docs/a/file.txt", false, false},
+		{[]string{"*.go"}, []string{"vendor"}, "vendor/file.go", false, true},
+	}
+
+	root := filepath.FromSlash("/root")
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			f := newPathFilter(withOpts{include: tt.include, exclude: tt.exclude})
+			path := filepath.Join(root, filepath.FromSlash(tt.path))
+			have := f.skip(root, path, func() bool { return tt.isDir })
+			if have != tt.want {
+				t.Errorf("include=%q exclude=%q: skip(%q) = %t; want %t",
+					tt.include, tt.exclude, tt.path, have, tt.want)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		w := newWatcher(t)
+		defer w.Close()
+		if err := w.AddWith(t.TempDir(), WithExclude("[")); err == nil {
+			t.Error("error is nil")
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Errorf("WatchList not empty: %q", l)
+		}
+	})
+}
+
+func TestGitignoreGlobal(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	// Default location.
+	mkdirAll(t, home, ".config", "git")
+	echoTrunc(t, "*.default", home, ".config", "git", "ignore")
+	if have, want := globalExcludesFile(), join(home, ".config", "git", "ignore"); have != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	// core.excludesFile.
+	echoTrunc(t, "[user]\n\tname = x\n[core]\n\texcludesFile = ~/.excludes\n", home, ".gitconfig")
+	echoTrunc(t, "*.global", home, ".excludes")
+	if have, want := globalExcludesFile(), join(home, ".excludes"); have != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, ".git", "info")
+	echoTrunc(t, "*.info\n!keep.global", tmp, ".git", "info", "exclude")
+	f := newPathFilter(withOpts{gitignore: true})
+	defer f.close()
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"file.global", true},
+		{"sub/file.global", true},
+		{"keep.global", false},
+		{"file.info", true},
+		{"file.default", false},
+		{".git", true},
+	} {
+		if have := f.skip(tmp, join(tmp, tt.path), nil); have != tt.want {
+			t.Errorf("skip(%q) = %t; want %t", tt.path, have, tt.want)
+		}
+	}
+
+	// Changes are picked up, even though there are no events for them.
+	later := time.Now().Add(time.Hour)
+	echoTrunc(t, "*.info2", tmp, ".git", "info", "exclude")
+	echoTrunc(t, "[core]\n\texcludesFile = ~/.excludes2\n", home, ".gitconfig")
+	echoTrunc(t, "*.global2", home, ".excludes2")
+	for _, p := range []string{join(tmp, ".git", "info", "exclude"), join(home, ".gitconfig")} {
+		if err := os.Chtimes(p, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.git.check(tmp) // Normally every ignoreRecheck.
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"file.global", false},
+		{"file.global2", true},
+		{"file.info", false},
+		{"file.info2", true},
+	} {
+		if have := f.skip(tmp, join(tmp, tt.path), nil); have != tt.want {
+			t.Errorf("skip(%q) = %t; want %t", tt.path, have, tt.want)
+		}
+	}
+}
+
+func TestEventStat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opts []addOpt
+		stat bool
+	}{
+		{"default", nil, false},
+		{"WithStat", []addOpt{WithStat()}, true},
+		{"polling", []addOpt{WithPolling(10 * time.Millisecond)}, false},
+		{"polling WithStat", []addOpt{WithPolling(10 * time.Millisecond), WithStat()}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w := newWatcher(t)
+			defer w.Close()
+			if err := w.AddWith(tmp, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+
+			mkdir(t, tmp, "dir")
+			echoTrunc(t, "data", tmp, "file")
+
+			// Read events until we have a Create for "dir" and a Create or
+			// Write for "file"; polling may not see the Write.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var dir, file Event
+			for dir.Name == "" || file.Name == "" {
+				e, err := w.Next(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch {
+				case filepath.Base(e.Name) == "dir" && e.Has(Create):
+					dir = e
+				case filepath.Base(e.Name) == "file" && e.Has(Create|Write):
+					file = e
+				}
+			}
+
+			if !tt.stat {
+				if dir.Stat != nil || file.Stat != nil {
+					t.Errorf("Stat set without WithStat:\n%s\n%s", dir, file)
+				}
+				// Windows doesn't report the file type.
+				if runtime.GOOS == "windows" && tt.opts == nil {
+					return
+				}
+			}
+			if !dir.IsDir || tt.stat && (dir.Stat == nil || !dir.Stat.IsDir()) {
+				t.Errorf("wrong event for dir: %s; IsDir=%t; Stat=%v", dir, dir.IsDir, dir.Stat)
+			}
+			if file.IsDir || tt.stat && (file.Stat == nil || file.Stat.Name() != "file" || !file.Stat.Mode().IsRegular()) {
+				t.Errorf("wrong event for file: %s; IsDir=%t; Stat=%v", file, file.IsDir, file.Stat)
+			}
+		})
+	}
+}
+
+func TestEventSeq(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opts []watcherOpt
+	}{
+		{"default", nil},
+		{"debounce", []watcherOpt{WithDebounce(10*time.Millisecond, 0)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w, err := NewWatcherWith(tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			addWatch(t, w, tmp)
+
+			start := time.Now()
+			for i := range 5 {
+				touch(t, tmp, fmt.Sprintf("file%d", i))
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var prev Event
+			for i := range 5 {
+				e, err := w.Next(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Seq != uint64(i+1) {
+					t.Errorf("wrong Seq for %s: %d; want %d", e, e.Seq, i+1)
+				}
+				if e.Time.Before(start) || e.Time.Before(prev.Time) || e.Time.After(time.Now()) {
+					t.Errorf("wrong Time for %s: %s; start %s; previous %s", e, e.Time, start, prev.Time)
+				}
+				prev = e
+			}
+		})
+	}
+}
+
+func TestNonExistent(t *testing.T) {
+	t.Parallel()
+
+	// Read events until there's one for the path.
+	next := func(t *testing.T, w *Watcher, path string) Event {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			e, err := w.Next(ctx)
+			if err != nil {
+				t.Fatalf("waiting for event for %q: %s", path, err)
+			}
+			if e.Name == path {
+				return e
+			}
+		}
+	}
+
+	t.Run("file", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		defer w.Close()
+
+		file := join(tmp, "one", "two", "file")
+		if err := w.AddWith(file, WithNonExistent()); err != nil {
+			t.Fatal(err)
+		}
+		if have := w.WatchList(); !slices.Equal(have, []string{file}) {
+			t.Errorf("wrong WatchList: %q", have)
+		}
+
+		mkdirAll(t, tmp, "one", "two")
+		touch(t, file)
+		if e := next(t, w, file); e.Op != Create || e.IsDir {
+			t.Errorf("wrong event: %s; IsDir=%t", e, e.IsDir)
+		}
+		echoAppend(t, "data", file)
+		if e := next(t, w, file); !e.Has(Write) {
+			t.Errorf("wrong event: %s", e)
+		}
+		if have := w.WatchList(); !slices.Equal(have, []string{file}) {
+			t.Errorf("wrong WatchList: %q", have)
+		}
+	})
+
+	t.Run("parent removed", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		defer w.Close()
+
+		dir := join(tmp, "one", "two")
+		if err := w.AddWith(dir, WithNonExistent()); err != nil {
+			t.Fatal(err)
+		}
+		mkdir(t, tmp, "one")
+		eventSeparator()
+		rmAll(t, tmp, "one")
+		eventSeparator()
+		mkdirAll(t, dir)
+		if e := next(t, w, dir); e.Op != Create || !e.IsDir {
+			t.Errorf("wrong event: %s; IsDir=%t", e, e.IsDir)
+		}
+		touch(t, dir, "file")
+		if e := next(t, w, join(dir, "file")); !e.Has(Create) {
+			t.Errorf("wrong event: %s", e)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		defer w.Close()
+
+		file := join(tmp, "file")
+		if err := w.AddWith(file, WithNonExistent()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+		if have := w.WatchList(); len(have) != 0 {
+			t.Errorf("wrong WatchList: %q", have)
+		}
+		touch(t, file)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if e, err := w.Next(ctx); err == nil {
+			t.Errorf("unexpected event: %s", e)
+		}
+	})
+}
+
+func TestFollowName(t *testing.T) {
+	t.Parallel()
+
+	// Collect all events until nothing was sent for a while.
+	collect := func(t *testing.T, w *Watcher) []string {
+		t.Helper()
+		var evs []string
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 4*followGrace)
+			e, err := w.Next(ctx)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				return evs
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			evs = append(evs, fmt.Sprintf("%s %s", e.Op, filepath.Base(e.Name)))
+		}
+	}
+
+	tests := []struct {
+		name string
+		do   func(t *testing.T, tmp string)
+		want []string
+		gone bool // File doesn't exist after do.
+	}{
+		{"write", func(t *testing.T, tmp string) {
+			echoAppend(t, "data", tmp, "file")
+		}, []string{"WRITE file"}, false},
+		{"rename over", func(t *testing.T, tmp string) {
+			echoTrunc(t, "new", tmp, "file.tmp")
+			mv(t, join(tmp, "file.tmp"), tmp, "file")
+		}, []string{"WRITE file"}, false},
+		{"remove and create", func(t *testing.T, tmp string) {
+			rm(t, tmp, "file")
+			touch(t, tmp, "file")
+		}, []string{"WRITE file"}, false},
+		{"rename and create", func(t *testing.T, tmp string) {
+			mv(t, join(tmp, "file"), tmp, "file.bak")
+			touch(t, tmp, "file")
+		}, []string{"WRITE file"}, false},
+		{"remove", func(t *testing.T, tmp string) {
+			rm(t, tmp, "file")
+			time.Sleep(2 * followGrace)
+			touch(t, tmp, "file")
+		}, []string{"REMOVE file", "CREATE file"}, false},
+		{"rename", func(t *testing.T, tmp string) {
+			mv(t, join(tmp, "file"), tmp, "other")
+		}, []string{"RENAME file"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			touch(t, tmp, "file")
+			touch(t, tmp, "other-file")
+			w := newWatcher(t)
+			defer w.Close()
+			if err := w.AddWith(join(tmp, "file"), WithFollowName()); err != nil {
+				t.Fatal(err)
+			}
+			if have := w.WatchList(); !slices.Equal(have, []string{join(tmp, "file")}) {
+				t.Errorf("wrong WatchList: %q", have)
+			}
+
+			echoAppend(t, "data", tmp, "other-file")
+			tt.do(t, tmp)
+			if have := collect(t, w); !slices.Equal(have, tt.want) {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+
+			// Still watched.
+			echoAppend(t, "data", tmp, "file")
+			want := []string{"WRITE file"}
+			if tt.gone {
+				want = []string{"CREATE file", "WRITE file"}
+			}
+			if have := collect(t, w); !slices.Equal(have, want) {
+				t.Errorf("\nhave: %q\nwant: %q", have, want)
+			}
+		})
+	}
+
+	t.Run("recursive", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		err := w.AddWith(join(t.TempDir(), "..."), WithFollowName())
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+// The parent directories for WithNonExistent() and WithFollowName() are
+// watched on the Watcher's own backend, and counted.
+func TestParentWatches(t *testing.T) {
+	t.Parallel()
+
+	t.Run("user watch", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newWatcher(t)
+		defer w.Close()
+
+		file := join(tmp, "new", "file")
+		if err := w.AddWith(file, WithNonExistent()); err != nil {
+			t.Fatal(err)
+		}
+		if n := w.WatchCount(); n < 1 {
+			t.Errorf("WatchCount: %d", n)
+		}
+		if s := w.Stats(); s.UserWatches != 0 {
+			t.Errorf("UserWatches: %d", s.UserWatches)
+		}
+		if err := w.Remove(tmp); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("wrong error: %v", err)
+		}
+
+		// Watching the same directory keeps the ops for both.
+		if err := w.AddWith(tmp, WithOps(Write)); err != nil {
+			t.Fatal(err)
+		}
+		have := w.WatchList()
+		slices.Sort(have)
+		if want := []string{tmp, file}; !slices.Equal(have, want) {
+			t.Errorf("wrong WatchList: %q", have)
+		}
+		if s := w.Stats(); s.UserWatches != 1 {
+			t.Errorf("UserWatches: %d", s.UserWatches)
+		}
+
+		echoAppend(t, "data", tmp, "file")
+		eventSeparator()
+		mkdir(t, tmp, "new")
+		touch(t, file)
+		var evs []string
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			e, err := w.Next(ctx)
+			if err != nil {
+				t.Fatalf("waiting for event for %q: %s; have %q", file, err, evs)
+			}
+			evs = append(evs, fmt.Sprintf("%s %s", e.Op, filepath.Base(e.Name)))
+			if e.Name == file {
+				break
+			}
+		}
+		if !slices.Contains(evs, "WRITE file") || slices.Contains(evs, "CREATE new") {
+			t.Errorf("wrong events: %q", evs)
+		}
+
+		if err := w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		if have := w.WatchList(); !slices.Equal(have, []string{file}) {
+			t.Errorf("wrong WatchList: %q", have)
+		}
+	})
+
+	// Same, but the user watches the directory first, without any options.
+	t.Run("user watch first", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newWatcher(t)
+		defer w.Close()
+
+		addWatch(t, w, tmp)
+		file := join(tmp, "new", "file")
+		if err := w.AddWith(file, WithNonExistent()); err != nil {
+			t.Fatal(err)
+		}
+		if s := w.Stats(); s.UserWatches != 1 {
+			t.Errorf("UserWatches: %d", s.UserWatches)
+		}
+
+		echoAppend(t, "data", tmp, "file")
+		eventSeparator()
+		mkdir(t, tmp, "new")
+		touch(t, file)
+		var evs []string
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			e, err := w.Next(ctx)
+			if err != nil {
+				t.Fatalf("waiting for event for %q: %s; have %q", file, err, evs)
+			}
+			evs = append(evs, fmt.Sprintf("%s %s", e.Op, filepath.Base(e.Name)))
+			if e.Name == file {
+				break
+			}
+		}
+		if !slices.Contains(evs, "WRITE file") || !slices.Contains(evs, "CREATE new") {
+			t.Errorf("wrong events: %q", evs)
+		}
+	})
+
+	t.Run("max watches", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir")
+		w, err := NewWatcherWith(WithMaxWatches(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		if err := w.AddWith(join(tmp, "dir", "file"), WithFollowName()); err != nil {
+			t.Fatal(err)
+		}
+		if n := w.WatchCount(); n != 1 {
+			t.Errorf("WatchCount: %d", n)
+		}
+		err = w.Add(tmp)
+		if !errors.Is(err, ErrWatchLimit) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if err := w.Remove(join(tmp, "dir", "file")); err != nil {
+			t.Fatal(err)
+		}
+		if n := w.WatchCount(); n != 0 {
+			t.Errorf("WatchCount: %d", n)
+		}
+		addWatch(t, w, tmp)
+	})
+}
+
+func TestMaxWatches(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir1")
+	mkdir(t, tmp, "dir2")
+	mkdir(t, tmp, "dir3")
+
+	w, err := NewWatcherWith(WithMaxWatches(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	addWatch(t, w, tmp, "dir1")
+	addWatch(t, w, tmp, "dir2")
+	addWatch(t, w, tmp, "dir2") // Already watched: doesn't use a new watch.
+	if n := w.WatchCount(); n != 2 {
+		t.Errorf("WatchCount: %d", n)
+	}
+
+	err = w.Add(join(tmp, "dir3"))
+	if !errors.Is(err, ErrWatchLimit) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if n := w.WatchCount(); n != 2 {
+		t.Errorf("WatchCount: %d", n)
+	}
+
+	rmWatch(t, w, tmp, "dir1")
+	addWatch(t, w, tmp, "dir3")
+}
+
+func TestWatchError(t *testing.T) {
+	err := watchError("add", "/dir", fs.ErrPermission)
+	if want := `fsnotify: add "/dir": permission denied`; err.Error() != want {
+		t.Errorf("\nhave: %s\nwant: %s", err, want)
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Error("doesn't unwrap")
+	}
+	if err := watchError("add", "/dir", nil); err != nil {
+		t.Errorf("not nil: %v", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	buf := new(bytes.Buffer)
+	w, err := NewWatcherWith(WithLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+	touch(t, tmp, "file")
+	select {
+	case <-w.Events:
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	w.Close() // Wait for the backend to finish writing to buf.
+
+	out := buf.String()
+	for _, want := range []string{
+		`level=DEBUG msg="fsnotify: watch" action=AddWith path=` + tmp,
+		`level=DEBUG msg="fsnotify: event" path=` + join(tmp, "file"),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+	if err := w.AddWith(tmp, WithExclude("*.skip")); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, tmp, "file.skip")
+	eventSeparator()
+	touch(t, tmp, "file")
+	select {
+	case e := <-w.Events:
+		if e.Name != join(tmp, "file") {
+			t.Fatalf("wrong event: %s", e)
+		}
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	s := w.Stats()
+	if s.Watches != w.WatchCount() || s.UserWatches != 1 {
+		t.Errorf("wrong watches: %+v", s)
+	}
+	if s.EventsRead < 2 || s.EventsSent < 1 || s.EventsFiltered < 1 || s.Errors != 0 {
+		t.Errorf("wrong counters: %+v", s)
+	}
+}
+
+func TestExisting(t *testing.T) {
+	t.Parallel()
+
+	t.Run("polling", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		mkdir(t, tmp, "sub")
+		touch(t, tmp, "sub", "file")
+
+		w := newCollector(t)
+		w.collect(t)
+		if err := w.w.AddWith(join(tmp, "..."), WithPolling(50*time.Millisecond), WithExisting()); err != nil {
+			t.Fatal(err)
+		}
+		eventSeparator()
+		rm(t, tmp, "sub", "file")
+		eventSeparator()
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create   /sub
+			create   /sub/file
+			remove   /sub/file
+		`))
+	})
+
+	t.Run("fanotify", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+
+		w, err := NewWatcherWith(WithFanotify())
+		if err != nil {
+			t.Skipf("fanotify not supported: %s", err)
+		}
+		c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+		c.collect(t)
+		if err := w.AddWith(tmp, WithExisting()); err != nil {
+			t.Fatal(err)
+		}
+		rm(t, tmp, "file")
+
+		cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+			create   /file
+			remove   /file
+		`))
+	})
+
+	t.Run("follow name", func(t *testing.T) {
+		t.Parallel()
+		w := newWatcher(t)
+		defer w.Close()
+		err := w.AddWith(join(t.TempDir(), "file"), WithFollowName(), WithExisting())
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestStateFile(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp   = t.TempDir()
+		state = join(t.TempDir(), "state.json")
+	)
+	// Collect all events until nothing was sent for a while.
+	collect := func(t *testing.T, w *Watcher) []string {
+		t.Helper()
+		var evs []string
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			e, err := w.Next(ctx)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				return evs
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev := fmt.Sprintf("%s %s", e.Op, filepath.Base(e.Name))
+			if e.RenamedFrom != "" {
+				ev += " ← " + filepath.Base(e.RenamedFrom)
+			}
+			evs = append(evs, ev)
+		}
+	}
+	watch := func(t *testing.T) *Watcher {
+		t.Helper()
+		w, err := NewWatcherWith(WithStateFile(state))
+		if errors.Is(err, ErrUnsupported) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Add(tmp); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	touch(t, tmp, "old")
+	touch(t, tmp, "mod")
+	touch(t, tmp, "ren")
+
+	// Nothing is sent the first time.
+	w := watch(t)
+	if evs := collect(t, w); len(evs) > 0 {
+		t.Errorf("events on first run: %s", evs)
+	}
+	touch(t, tmp, "live")
+	if have := collect(t, w); !slices.Equal(have, []string{"CREATE live"}) {
+		t.Errorf("\nhave: %s", have)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change things while nothing is watching.
+	rm(t, tmp, "old")
+	echoAppend(t, "data", tmp, "mod")
+	mv(t, join(tmp, "ren"), tmp, "renamed")
+	touch(t, tmp, "new")
+
+	w = watch(t)
+	defer w.Close()
+	want := []string{"RENAME ren", "REMOVE old", "CREATE new", "CREATE renamed ← ren", "WRITE mod"}
+	if have := collect(t, w); !slices.Equal(have, want) {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestRenamePairing(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("only inotify and fanotify report the new name")
+	}
+
+	var (
+		tmp = t.TempDir()
+		out = t.TempDir()
+	)
+	mkdir(t, tmp, "dir1")
+	mkdir(t, tmp, "dir2")
+	touch(t, tmp, "dir1", "file")
+	touch(t, out, "in")
+
+	w, err := NewWatcherWith(WithRenamePairing(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp, "dir1")
+	addWatch(t, w, tmp, "dir2")
+
+	mv(t, join(tmp, "dir1", "file"), tmp, "dir2", "file") // Between two watches.
+	mv(t, join(tmp, "dir2", "file"), out, "file")         // Moved out.
+	touch(t, tmp, "dir1", "after")                        // Held until the previous is due.
+	mv(t, join(out, "in"), tmp, "dir1", "in")             // Moved in.
+
+	var have []string
+	for len(have) < 5 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		e, err := w.Next(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s; have: %q", err, have)
+		}
+		ev := fmt.Sprintf("%s %s", e.Op, strings.TrimPrefix(filepath.ToSlash(e.Name), filepath.ToSlash(tmp)))
+		if e.RenamedFrom != "" {
+			ev += " ← " + strings.TrimPrefix(filepath.ToSlash(e.RenamedFrom), filepath.ToSlash(tmp))
+		}
+		have = append(have, ev)
+	}
+	want := []string{
+		"RENAME /dir1/file",
+		"CREATE /dir2/file ← /dir1/file",
+		"REMOVE|RENAME /dir2/file",
+		"CREATE /dir1/after",
+		"CREATE /dir1/in",
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir1")
+	mkdir(t, tmp, "dir2")
+
+	w := newWatcher(t)
+	defer w.Close()
+	addWatch(t, w, tmp, "dir1")
+	addWatch(t, w, tmp, "dir2")
+
+	sub := func(prefix string, ops Op) *Subscription {
+		t.Helper()
+		s, err := w.Subscribe(prefix, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	next := func(s *Subscription) string {
+		t.Helper()
+		select {
+		case e, ok := <-s.Events:
+			if !ok {
+				return "closed"
+			}
+			return fmt.Sprintf("%s %s", e.Op, strings.TrimPrefix(filepath.ToSlash(e.Name), filepath.ToSlash(tmp)))
+		case err, ok := <-s.Errors:
+			if !ok {
+				return "closed"
+			}
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return ""
+	}
+	check := func(have, want string) {
+		t.Helper()
+		if have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+
+	var (
+		sub1 = sub(join(tmp, "dir1"), Create)
+		sub2 = sub(join(tmp, "dir2"), Create|Remove)
+		all  = sub("", Remove)
+	)
+
+	touch(t, tmp, "dir1", "a")
+	check(next(sub1), "CREATE /dir1/a")
+
+	touch(t, tmp, "dir2", "b")
+	rm(t, tmp, "dir2", "b")
+	check(next(sub2), "CREATE /dir2/b")
+	check(next(sub2), "REMOVE /dir2/b")
+	check(next(all), "REMOVE /dir2/b")
+
+	sub1.Close()
+	check(next(sub1), "closed")
+	touch(t, tmp, "dir1", "c") // Shouldn't block on sub1.
+	touch(t, tmp, "dir2", "d")
+	check(next(sub2), "CREATE /dir2/d")
+
+	w.Close()
+	check(next(sub2), "closed")
+	check(next(all), "closed")
+	if _, err := w.Subscribe("", 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// A subscription that doesn't read Errors shouldn't block the others.
+func TestSubscribeErrors(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+	addWatch(t, w, tmp)
+
+	unread, err := w.Subscribe("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unread.Close()
+	s, err := w.Subscribe("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		select {
+		case w.Errors <- errors.New("oops"):
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked on sending error")
+		}
+	}
+	go func() {
+		for range unread.Events {
+		}
+	}()
+	touch(t, tmp, "file")
+	for {
+		select {
+		case e := <-s.Events:
+			if e.Name == join(tmp, "file") {
+				return
+			}
+		case <-s.Errors:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	t.Run("in order", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+
+		var (
+			events  = make(chan string, 10)
+			release = make(chan struct{})
+		)
+		w, err := NewWatcherWith(WithHandler(func(e Event) {
+			<-release
+			events <- fmt.Sprintf("%s %s", e.Op, filepath.Base(e.Name))
+		}, func(err error) { t.Error(err) }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addWatch(t, w, tmp)
+		touch(t, tmp, "a")
+		touch(t, tmp, "b")
+
+		closed := make(chan struct{})
+		go func() {
+			w.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+			t.Fatal("Close() didn't wait for the handler")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+
+		// The second event may have been dropped on Close, but if it was
+		// handled it must be after the first.
+		close(events)
+		var have []string
+		for e := range events {
+			have = append(have, e)
+		}
+		if len(have) == 0 || have[0] != "CREATE a" || (len(have) > 1 && have[1] != "CREATE b") {
+			t.Errorf("wrong events: %q", have)
+		}
+	})
+
+	t.Run("workers", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+
+		var (
+			mu   sync.Mutex
+			have = make(map[string][]string)
+			n    atomic.Int32
+		)
+		w, err := NewWatcherWith(
+			WithHandler(func(e Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				have[filepath.Base(e.Name)] = append(have[filepath.Base(e.Name)], e.Op.String())
+				n.Add(1)
+			}, nil),
+			WithHandlerWorkers(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp)
+
+		files := []string{"a", "b", "c", "d", "e", "f"}
+		for _, f := range files {
+			touch(t, tmp, f)
+			echoAppend(t, "data", tmp, f)
+			rm(t, tmp, f)
+		}
+		for start := time.Now(); n.Load() < int32(len(files)*3); {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timeout; have %d events", n.Load())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range files {
+			if want := []string{"CREATE", "WRITE", "REMOVE"}; !slices.Equal(have[f], want) {
+				t.Errorf("%s:\nhave: %q\nwant: %q", f, have[f], want)
+			}
+		}
+	})
+}
@@ -0,0 +1,302 @@
+package fsnotify
+
+import (
+	"bufio"
+	"bytes"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitignore has the rules from the .gitignore and .ignore files in a watched
+// directory, as set with WithGitignore().
+//
+// The files are read when they're first needed, and read again after an event
+// for them. There are no events for the global excludes and .git/info/exclude,
+// so these are read again from recheck() if their mtime changed.
+type gitignore struct {
+	mu     sync.Mutex
+	global []ignoreRule            // Global excludes and .git/info/exclude.
+	loaded bool                    // Global rules are loaded.
+	mtimes map[string]time.Time    // Files the global rules depend on → mtime.
+	stop   chan struct{}           // Stops recheck(); nil if it's not running.
+	closed bool                    // close() was called; don't start recheck().
+	dirs   map[string][]ignoreRule // Directory relative to root → rules in it.
+}
+
+type ignoreRule struct {
+	pattern string // Same syntax as WithExclude().
+	negate  bool   // Starts with "!".
+}
+
+// Names of the files to read rules from, in order of precedence.
+var ignoreFiles = []string{".gitignore", ".ignore"}
+
+// How often to check if the global rules changed.
+var ignoreRecheck = time.Second
+
+func newGitignore() *gitignore {
+	return &gitignore{dirs: make(map[string][]ignoreRule)}
+}
+
+// Report if the path is ignored, as a list of path components relative to
+// root. This only checks the path itself: parent directories are checked by
+// the caller.
+func (g *gitignore) ignored(root string, parts []string, isDir func() bool) bool {
+	if parts[len(parts)-1] == ".git" {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.loaded {
+		g.mtimes = modTimes(globalIgnoreFiles(root))
+		g.global = loadGlobalIgnore(root)
+		g.loaded = true
+		if g.stop == nil && !g.closed {
+			g.stop = make(chan struct{})
+			go g.recheck(root, g.stop)
+		}
+	}
+
+	// Rules in deeper directories override those higher up, and later rules
+	// override earlier ones.
+	ignored := false
+	check := func(rules []ignoreRule, rel []string) {
+		for _, r := range rules {
+			if matchPattern(r.pattern, rel, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	check(g.global, parts)
+	for i := range parts {
+		dir := path.Join(parts[:i]...)
+		rules, ok := g.dirs[dir]
+		if !ok {
+			rules = loadIgnore(filepath.Join(root, filepath.FromSlash(dir)))
+			g.dirs[dir] = rules
+		}
+		check(rules, parts[i:])
+	}
+	return ignored
+}
+
+// Read the global rules again every ignoreRecheck if the files they depend on
+// changed. This is done in its own goroutine rather than from ignored(), so
+// that sending events never waits for it.
+func (g *gitignore) recheck(root string, stop chan struct{}) {
+	t := time.NewTicker(ignoreRecheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			g.check(root)
+		}
+	}
+}
+
+// Read the global rules again if the files they depend on changed.
+func (g *gitignore) check(root string) {
+	mtimes := modTimes(globalIgnoreFiles(root))
+	g.mu.Lock()
+	same := maps.Equal(g.mtimes, mtimes)
+	g.mu.Unlock()
+	if same {
+		return
+	}
+
+	global := loadGlobalIgnore(root)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.mtimes, g.global = mtimes, global
+}
+
+// Stop checking the global rules.
+func (g *gitignore) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+}
+
+// Forget the rules for the directory if the path is an ignore file, so they're
+// read again the next time they're needed.
+func (g *gitignore) changed(root, name string) {
+	if !slices.Contains(ignoreFiles, filepath.Base(name)) {
+		return
+	}
+	dir, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil {
+		return
+	}
+	dir = filepath.ToSlash(dir)
+	if dir == "." {
+		dir = ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.dirs, dir)
+}
+
+// Read the rules from the ignore files in dir.
+func loadIgnore(dir string) []ignoreRule {
+	var rules []ignoreRule
+	for _, f := range ignoreFiles {
+		rules = append(rules, readIgnore(filepath.Join(dir, f))...)
+	}
+	return rules
+}
+
+// Read the global excludes file and .git/info/exclude in root.
+func loadGlobalIgnore(root string) []ignoreRule {
+	var rules []ignoreRule
+	if f := globalExcludesFile(); f != "" {
+		rules = readIgnore(f)
+	}
+	return append(rules, readIgnore(filepath.Join(root, ".git", "info", "exclude"))...)
+}
+
+// Get the files the global rules are read from: the git config files, as
+// core.excludesFile may change, the global excludes file, and
+// .git/info/exclude in root.
+func globalIgnoreFiles(root string) []string {
+	files := gitConfigFiles()
+	if f := globalExcludesFile(); f != "" {
+		files = append(files, f)
+	}
+	return append(files, filepath.Join(root, ".git", "info", "exclude"))
+}
+
+// Get the mtime of every file; files that don't exist have the zero time.
+func modTimes(files []string) map[string]time.Time {
+	m := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		var t time.Time
+		if fi, err := os.Stat(f); err == nil {
+			t = fi.ModTime()
+		}
+		m[f] = t
+	}
+	return m
+}
+
+// Parse an ignore file; see gitignore(5). Returns nil if the file can't be
+// read.
+func readIgnore(file string) []ignoreRule {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		// Trailing spaces are ignored unless they're escaped.
+		line = strings.TrimSuffix(line, "\r")
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var r ignoreRule
+		switch {
+		case line[0] == '!':
+			r.negate, line = true, line[1:]
+		case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+			line = line[1:]
+		}
+		if strings.Trim(line, "/") == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Get the path to the global excludes file: core.excludesFile from the git
+// config, or $XDG_CONFIG_HOME/git/ignore.
+func globalExcludesFile() string {
+	home, xdg := gitConfigDirs()
+
+	// Later files take precedence.
+	var file string
+	for _, c := range gitConfigFiles() {
+		if f := readExcludesFile(c); f != "" {
+			file = f
+		}
+	}
+	if file == "" && xdg != "" {
+		file = filepath.Join(xdg, "git", "ignore")
+	}
+	if home != "" && (file == "~" || strings.HasPrefix(file, "~/")) {
+		file = filepath.Join(home, file[1:])
+	}
+	return file
+}
+
+// Get the home directory and $XDG_CONFIG_HOME, which defaults to ~/.config.
+func gitConfigDirs() (home, xdg string) {
+	home, _ = os.UserHomeDir()
+	xdg = os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	return home, xdg
+}
+
+// Get the git config files that may set core.excludesFile, in order of
+// precedence.
+func gitConfigFiles() []string {
+	home, xdg := gitConfigDirs()
+	var configs []string
+	if xdg != "" {
+		configs = append(configs, filepath.Join(xdg, "git", "config"))
+	}
+	if home != "" {
+		configs = append(configs, filepath.Join(home, ".gitconfig"))
+	}
+	return configs
+}
+
+// Get core.excludesFile from a git config file.
+func readExcludesFile(config string) string {
+	fp, err := os.Open(config)
+	if err != nil {
+		return ""
+	}
+	defer fp.Close()
+
+	var (
+		file string
+		core bool
+		scan = bufio.NewScanner(fp)
+	)
+	for scan.Scan() {
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			core = bytes.EqualFold(bytes.Trim(line, "[] \t"), []byte("core"))
+			continue
+		}
+		k, v, ok := bytes.Cut(line, []byte("="))
+		if core && ok && bytes.EqualFold(bytes.TrimSpace(k), []byte("excludesfile")) {
+			file = strings.Trim(string(bytes.TrimSpace(v)), `"`)
+		}
+	}
+	return file
+}
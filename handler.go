@@ -0,0 +1,83 @@
+package fsnotify
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// handler calls the functions from WithHandler() for every event and error,
+// instead of the user reading the Events and Errors channels.
+type handler struct {
+	onEvent func(Event)
+	onError func(error)
+	workers []chan Event // Events for every worker; nil if there are no workers.
+	wg      sync.WaitGroup
+	done    chan struct{} // Closed when handle() is done and all handlers returned.
+}
+
+func newHandler(onEvent func(Event), onError func(error), workers int, bufsize uint) *handler {
+	h := &handler{onEvent: onEvent, onError: onError, done: make(chan struct{})}
+	if workers > 1 && onEvent != nil {
+		h.workers = make([]chan Event, workers)
+		for i := range h.workers {
+			h.workers[i] = make(chan Event, bufsize)
+		}
+	}
+	return h
+}
+
+// Read the Events and Errors channels and call the handlers, until the Watcher
+// is closed.
+func (w *Watcher) handle() {
+	h := w.handler
+	defer close(h.done)
+
+	for _, ch := range h.workers {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for e := range ch {
+				h.onEvent(e)
+			}
+		}()
+	}
+
+	events, errs := w.Events, w.Errors
+	for events != nil || errs != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			h.event(e)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if h.onError != nil {
+				h.onError(err)
+			}
+		}
+	}
+
+	for _, ch := range h.workers {
+		close(ch)
+	}
+	h.wg.Wait()
+}
+
+// Call the event handler, or queue the event for the worker for this path, so
+// that events for the same path are always handled in order.
+func (h *handler) event(e Event) {
+	switch {
+	case h.onEvent == nil:
+	case len(h.workers) == 0:
+		h.onEvent(e)
+	default:
+		f := fnv.New32a()
+		f.Write([]byte(e.Name))
+		h.workers[f.Sum32()%uint32(len(h.workers))] <- e
+	}
+}
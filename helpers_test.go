@@ -452,8 +452,8 @@ func (e Events) String() string {
 		if i > 0 {
 			b.WriteString("\n")
 		}
-		if ee.renamedFrom != "" {
-			fmt.Fprintf(b, "%-8s %s ← %s", ee.Op.String(), filepath.ToSlash(ee.Name), filepath.ToSlash(ee.renamedFrom))
+		if ee.RenamedFrom != "" {
+			fmt.Fprintf(b, "%-8s %s ← %s", ee.Op.String(), filepath.ToSlash(ee.Name), filepath.ToSlash(ee.RenamedFrom))
 		} else {
 			fmt.Fprintf(b, "%-8s %s", ee.Op.String(), filepath.ToSlash(ee.Name))
 		}
@@ -468,10 +468,10 @@ func (e Events) TrimPrefix(prefix string) Events {
 		} else {
 			e[i].Name = strings.TrimPrefix(e[i].Name, prefix)
 		}
-		if e[i].renamedFrom == prefix {
-			e[i].renamedFrom = "/"
+		if e[i].RenamedFrom == prefix {
+			e[i].RenamedFrom = "/"
 		} else {
-			e[i].renamedFrom = strings.TrimPrefix(e[i].renamedFrom, prefix)
+			e[i].RenamedFrom = strings.TrimPrefix(e[i].RenamedFrom, prefix)
 		}
 	}
 	return e
@@ -552,13 +552,17 @@ func newEvents(t *testing.T, s string) Events {
 			case "CHMOD":
 				op |= Chmod
 			case "OPEN":
-				op |= xUnportableOpen
+				op |= UnportableOpen
 			case "READ":
-				op |= xUnportableRead
+				op |= UnportableRead
 			case "CLOSE_WRITE":
-				op |= xUnportableCloseWrite
+				op |= UnportableCloseWrite
 			case "CLOSE_READ":
-				op |= xUnportableCloseRead
+				op |= UnportableCloseRead
+			case "UNWATCH":
+				op |= UnportableUnwatch
+			case "UNMOUNT":
+				op |= UnportableUnmount
 			default:
 				t.Fatalf("newEvents: line %d has unknown event %q: %s", no+1, ee, line)
 			}
@@ -576,7 +580,7 @@ func newEvents(t *testing.T, s string) Events {
 		}
 
 		for _, g := range groups {
-			events[g] = append(events[g], Event{Name: strings.Trim(fields[1], `"`), renamedFrom: from, Op: op})
+			events[g] = append(events[g], Event{Name: strings.Trim(fields[1], `"`), RenamedFrom: from, Op: op})
 		}
 	}
 
@@ -645,15 +649,6 @@ func supportsRecurse(t *testing.T) {
 	}
 }
 
-func supportsFilter(t *testing.T) {
-	switch runtime.GOOS {
-	case "linux":
-		// Run test.
-	default:
-		t.Skip("withOps() not yet supported on " + runtime.GOOS)
-	}
-}
-
 func supportsRename() bool {
 	switch runtime.GOOS {
 	case "linux", "windows":
@@ -795,6 +790,14 @@ loop:
 				if runtime.GOOS != "linux" {
 					t.Skip("No CloseRead on this platform")
 				}
+			case "op_unwatch":
+				if runtime.GOOS != "linux" {
+					t.Skip("No Unwatch on this platform")
+				}
+			case "existing":
+				if runtime.GOOS != "linux" {
+					t.Skip("WithExisting() not supported on this platform")
+				}
 			case "always":
 				t.Skip()
 			case "symlink":
@@ -820,8 +823,6 @@ loop:
 				}
 			case "recurse":
 				supportsRecurse(t)
-			case "filter":
-				supportsFilter(t)
 			case "windows":
 				if runtime.GOOS == "windows" {
 					t.Skip("Skipping on Windows")
@@ -865,11 +866,27 @@ loop:
 				continue
 			}
 
-			var op Op
+			var (
+				op                  Op
+				include, exclude    []string
+				gitignore, existing bool
+			)
 			for _, o := range c.args[1:] {
+				if pat, ok := strings.CutPrefix(o, "include="); ok {
+					include = append(include, pat)
+					continue
+				}
+				if pat, ok := strings.CutPrefix(o, "exclude="); ok {
+					exclude = append(exclude, pat)
+					continue
+				}
 				switch strings.ToLower(o) {
 				default:
 					t.Fatalf("line %d: unknown: %q", c.line+1, o)
+				case "gitignore":
+					gitignore = true
+				case "existing":
+					existing = true
 				case "default":
 					op |= Create | Write | Remove | Rename | Chmod
 				case "create":
@@ -883,18 +900,30 @@ loop:
 				case "chmod":
 					op |= Chmod
 				case "open":
-					op |= xUnportableOpen
+					op |= UnportableOpen
 				case "read":
-					op |= xUnportableRead
+					op |= UnportableRead
 				case "close_write":
-					op |= xUnportableCloseWrite
+					op |= UnportableCloseWrite
 				case "close_read":
-					op |= xUnportableCloseRead
+					op |= UnportableCloseRead
+				case "unwatch":
+					op |= UnportableUnwatch
 				}
 			}
+			if op == 0 {
+				op = defaultOpts.op
+			}
 			do = append(do, func(w *Watcher) {
 				p := tmppath(tmp, c.args[0])
-				err := w.AddWith(p, withOps(op))
+				opts := []addOpt{WithOps(op), WithInclude(include...), WithExclude(exclude...)}
+				if gitignore {
+					opts = append(opts, WithGitignore())
+				}
+				if existing {
+					opts = append(opts, WithExisting())
+				}
+				err := w.AddWith(p, opts...)
 				if err != nil {
 					t.Fatalf("line %d: addWatch(%q): %s", c.line+1, p, err)
 				}
@@ -929,6 +958,18 @@ loop:
 					}
 				})
 			}
+		case "watchcount":
+			mustArg(c, 1)
+			n, err := strconv.Atoi(c.args[0])
+			if err != nil {
+				t.Fatalf("line %d: %s", c.line, err)
+			}
+			do = append(do, func(w *Watcher) {
+				eventSeparator() // Wait for the events that add or remove watches.
+				if have := w.WatchCount(); have != n {
+					t.Errorf("line %d: WatchCount is %d, not %d", c.line, have, n)
+				}
+			})
 		case "touch":
 			mustArg(c, 1)
 			do = append(do, func(w *Watcher) { touch(t, tmppath(tmp, c.args[0])) })
@@ -4,16 +4,18 @@ package internal
 
 import (
 	"fmt"
-	"os"
 	"strings"
-	"time"
-
-	"golang.org/x/sys/unix"
 )
 
-func Debug(name string, kevent *unix.Kevent_t) {
-	mask := uint32(kevent.Fflags)
+// KqueueMask gets the names of the NOTE_* flags in mask.
+func KqueueMask(mask uint32) string { return strings.Join(kqueueNames(mask), "|") }
+
+// Debug gets the FSNOTIFY_DEBUG message for an event.
+func Debug(name string, mask uint32) string {
+	return fmt.Sprintf("%10d:%-20s → %q", mask, strings.Join(kqueueNames(mask), " | "), name)
+}
 
+func kqueueNames(mask uint32) []string {
 	var (
 		l       []string
 		unknown = mask
@@ -27,6 +29,5 @@ func Debug(name string, kevent *unix.Kevent_t) {
 	if unknown > 0 {
 		l = append(l, fmt.Sprintf("0x%x", unknown))
 	}
-	fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %10d:%-20s → %q\n",
-		time.Now().Format("15:04:05.000000000"), mask, strings.Join(l, " | "), name)
+	return l
 }
@@ -2,14 +2,20 @@ package internal
 
 import (
 	"fmt"
-	"os"
 	"strings"
-	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func Debug(name string, mask int32) {
+// FenMask gets the names of the FILE_* flags in mask.
+func FenMask(mask int32) string { return strings.Join(fenNames(mask), "|") }
+
+// Debug gets the FSNOTIFY_DEBUG message for an event.
+func Debug(name string, mask int32) string {
+	return fmt.Sprintf("%10d:%-30s → %q", mask, strings.Join(fenNames(mask), " | "), name)
+}
+
+func fenNames(mask int32) []string {
 	names := []struct {
 		n string
 		m int32
@@ -40,6 +46,5 @@ func Debug(name string, mask int32) {
 	if unknown > 0 {
 		l = append(l, fmt.Sprintf("0x%x", unknown))
 	}
-	fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %10d:%-30s → %q\n",
-		time.Now().Format("15:04:05.000000000"), mask, strings.Join(l, " | "), name)
+	return l
 }
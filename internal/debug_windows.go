@@ -2,15 +2,21 @@ package internal
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"golang.org/x/sys/windows"
 )
 
-func Debug(name string, mask uint32) {
+// WindowsMask gets the names of the FILE_ACTION_* flags in mask.
+func WindowsMask(mask uint32) string { return strings.Join(windowsNames(mask), "|") }
+
+// Debug gets the FSNOTIFY_DEBUG message for an event.
+func Debug(name string, mask uint32) string {
+	return fmt.Sprintf("%-65s → %q", strings.Join(windowsNames(mask), " | "), filepath.ToSlash(name))
+}
+
+func windowsNames(mask uint32) []string {
 	names := []struct {
 		n string
 		m uint32
@@ -35,6 +41,5 @@ func Debug(name string, mask uint32) {
 	if unknown > 0 {
 		l = append(l, fmt.Sprintf("0x%x", unknown))
 	}
-	fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %-65s → %q\n",
-		time.Now().Format("15:04:05.000000000"), strings.Join(l, " | "), filepath.ToSlash(name))
+	return l
 }
@@ -0,0 +1,67 @@
+package fsnotify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// logger writes debug messages to the *slog.Logger set with WithLogger(), and
+// to stderr if FSNOTIFY_DEBUG=1 is set.
+//
+// The *slog.Logger is set after the backend's goroutine is started, so it's
+// stored in an atomic.
+type logger struct{ l atomic.Pointer[slog.Logger] }
+
+func (l *logger) set(sl *slog.Logger) { l.l.Store(sl) }
+
+// Reports if anything will be logged; use this to avoid formatting the mask
+// when it's not needed.
+func (l *logger) enabled() bool {
+	sl := l.l.Load()
+	return debug || (sl != nil && sl.Enabled(context.Background(), slog.LevelDebug))
+}
+
+// Log an event as it was read from the kernel, before any processing. mask has
+// the names of the flags in raw, and msg is the backend's message for
+// FSNOTIFY_DEBUG.
+func (l *logger) event(msg, path, mask string, raw uint64, cookie uint32) {
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %s\n",
+			time.Now().Format("15:04:05.000000000"), msg)
+	}
+	if sl := l.l.Load(); sl != nil {
+		attrs := []slog.Attr{slog.String("path", path), slog.String("mask", mask), slog.Uint64("raw", raw)}
+		if cookie > 0 {
+			attrs = append(attrs, slog.Uint64("cookie", uint64(cookie)))
+		}
+		sl.LogAttrs(context.Background(), slog.LevelDebug, "fsnotify: event", attrs...)
+	}
+}
+
+// Log adding or removing a watch; action is e.g. "AddWith" or "Remove". attrs
+// are added to the slog record, e.g. the watch descriptor.
+func (l *logger) watch(action, path string, attrs ...slog.Attr) {
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %s(%q)\n",
+			time.Now().Format("15:04:05.000000000"), action, path)
+	}
+	if sl := l.l.Load(); sl != nil {
+		attrs = append([]slog.Attr{slog.String("action", action), slog.String("path", path)}, attrs...)
+		sl.LogAttrs(context.Background(), slog.LevelDebug, "fsnotify: watch", attrs...)
+	}
+}
+
+// Log an error that's sent on the Errors channel.
+func (l *logger) error(err error) {
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  error: %s\n",
+			time.Now().Format("15:04:05.000000000"), err)
+	}
+	if sl := l.l.Load(); sl != nil {
+		sl.LogAttrs(context.Background(), slog.LevelDebug, "fsnotify: error", slog.Any("err", err))
+	}
+}
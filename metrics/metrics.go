@@ -0,0 +1,143 @@
+// Package metrics exposes the Stats of fsnotify Watchers with expvar or in the
+// Prometheus text format.
+//
+// This doesn't depend on the Prometheus client libraries; use the Handler as a
+// scrape target, or write the metrics to a file for the node_exporter textfile
+// collector with WriteTo.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Collector collects the Stats of one or more Watchers.
+//
+// A Collector is an expvar.Var, so it can be published with:
+//
+//	c := metrics.NewCollector()
+//	c.Register("config", w)
+//	expvar.Publish("fsnotify", c)
+//
+// Or to serve the metrics in the Prometheus text format:
+//
+//	http.Handle("/metrics", c)
+type Collector struct {
+	mu       sync.Mutex
+	watchers map[string]*fsnotify.Watcher
+}
+
+// NewCollector creates a new Collector without any Watchers.
+func NewCollector() *Collector {
+	return &Collector{watchers: make(map[string]*fsnotify.Watcher)}
+}
+
+// Register adds the Watcher as name, replacing any Watcher that's already
+// registered with that name. The name is used as the "watcher" label.
+func (c *Collector) Register(name string, w *fsnotify.Watcher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watchers[name] = w
+}
+
+// Unregister removes the Watcher registered as name; this is a no-op if there
+// is no Watcher with that name.
+func (c *Collector) Unregister(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.watchers, name)
+}
+
+type named struct {
+	name  string
+	stats fsnotify.Stats
+}
+
+// Get the stats for all Watchers, sorted by name.
+func (c *Collector) collect() []named {
+	c.mu.Lock()
+	l := make([]named, 0, len(c.watchers))
+	ws := make([]*fsnotify.Watcher, 0, len(c.watchers))
+	for name, w := range c.watchers {
+		l = append(l, named{name: name})
+		ws = append(ws, w)
+	}
+	c.mu.Unlock()
+
+	for i, w := range ws {
+		l[i].stats = w.Stats()
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].name < l[j].name })
+	return l
+}
+
+// String returns the Stats of all Watchers as a JSON object, keyed by name. This
+// implements expvar.Var.
+func (c *Collector) String() string {
+	m := make(map[string]fsnotify.Stats)
+	for _, n := range c.collect() {
+		m[n.name] = n.stats
+	}
+	j, err := json.Marshal(m)
+	if err != nil { // Should never happen.
+		return "{}"
+	}
+	return string(j)
+}
+
+var metrics = []struct {
+	name, typ, help string
+	get             func(fsnotify.Stats) uint64
+}{
+	{"fsnotify_watches", "gauge", "Number of watches in use.",
+		func(s fsnotify.Stats) uint64 { return uint64(s.Watches) }},
+	{"fsnotify_user_watches", "gauge", "Number of watches for paths added with Add().",
+		func(s fsnotify.Stats) uint64 { return uint64(s.UserWatches) }},
+	{"fsnotify_events_read_total", "counter", "Events read from the kernel.",
+		func(s fsnotify.Stats) uint64 { return s.EventsRead }},
+	{"fsnotify_events_sent_total", "counter", "Events sent on the Events channel.",
+		func(s fsnotify.Stats) uint64 { return s.EventsSent }},
+	{"fsnotify_events_filtered_total", "counter", "Events dropped by filters.",
+		func(s fsnotify.Stats) uint64 { return s.EventsFiltered }},
+	{"fsnotify_overflows_total", "counter", "Number of times the kernel queue overflowed.",
+		func(s fsnotify.Stats) uint64 { return s.Overflows }},
+	{"fsnotify_errors_total", "counter", "Errors sent on the Errors channel.",
+		func(s fsnotify.Stats) uint64 { return s.Errors }},
+	{"fsnotify_read_bytes_total", "counter", "Bytes read from the kernel.",
+		func(s fsnotify.Stats) uint64 { return s.BytesRead }},
+}
+
+// WriteTo writes the metrics for all Watchers in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	var (
+		b     strings.Builder
+		stats = c.collect()
+	)
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, n := range stats {
+			fmt.Fprintf(&b, "%s{watcher=%s} %d\n", m.name, quote(n.name), m.get(n.stats))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// Quote a label value; this is not the same as strconv.Quote, as only \, ",
+// and newlines are escaped.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
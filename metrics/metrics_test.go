@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestCollector(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Events:
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	c := NewCollector()
+	c.Register("a\"b", w)
+
+	var m map[string]fsnotify.Stats
+	if err := json.Unmarshal([]byte(c.String()), &m); err != nil {
+		t.Fatal(err)
+	}
+	if s := m["a\"b"]; s.Watches != 1 || s.UserWatches != 1 || s.EventsSent < 1 {
+		t.Errorf("wrong stats: %+v", s)
+	}
+
+	b := new(strings.Builder)
+	if _, err := c.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE fsnotify_watches gauge\n",
+		`fsnotify_watches{watcher="a\"b"} 1` + "\n",
+		"# TYPE fsnotify_events_sent_total counter\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("no %q in output:\n%s", want, b)
+		}
+	}
+
+	c.Unregister("a\"b")
+	if have := c.String(); have != "{}" {
+		t.Errorf("not empty after Unregister: %s", have)
+	}
+}
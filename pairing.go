@@ -0,0 +1,98 @@
+package fsnotify
+
+import "time"
+
+// renamePairer holds Rename events until a Create with RenamedFrom set to the
+// same path is seen, or until the window has passed, after which it's sent as
+// Remove|Rename.
+//
+// Events after a Rename that's waiting for a pair are held as well, so that
+// the order doesn't change. This is only used from forward(), so doesn't need
+// locking.
+type renamePairer struct {
+	window time.Duration
+	queue  []heldEvent
+}
+
+type heldEvent struct {
+	ev       Event
+	deadline time.Time // Waiting for a pair until this time; zero if not waiting.
+}
+
+func newRenamePairer(window time.Duration) *renamePairer {
+	return &renamePairer{window: window}
+}
+
+// Add an event, and return the events that can be sent.
+func (p *renamePairer) add(e Event, now time.Time) []Event {
+	if e.Has(Create) && e.RenamedFrom != "" {
+		// Could be more than one, e.g. for a watched directory that's renamed
+		// inside a watched directory.
+		for i := range p.queue {
+			if !p.queue[i].deadline.IsZero() && p.queue[i].ev.Name == e.RenamedFrom {
+				p.queue[i].deadline = time.Time{}
+			}
+		}
+	}
+
+	h := heldEvent{ev: e}
+	if e.Has(Rename) && !e.Has(Create) {
+		h.deadline = now.Add(p.window)
+	}
+	if len(p.queue) == 0 && h.deadline.IsZero() {
+		return []Event{e}
+	}
+	p.queue = append(p.queue, h)
+	return p.ready()
+}
+
+// Get the time until the next Rename without a pair is due, or false if
+// nothing is waiting for a pair.
+func (p *renamePairer) next(now time.Time) (time.Duration, bool) {
+	for _, h := range p.queue {
+		if !h.deadline.IsZero() {
+			return max(h.deadline.Sub(now), 0), true
+		}
+	}
+	return 0, false
+}
+
+// Set Remove on all Renames whose window has passed, and return the events
+// that can be sent.
+func (p *renamePairer) due(now time.Time) []Event {
+	for i := range p.queue {
+		if d := p.queue[i].deadline; !d.IsZero() && !d.After(now) {
+			p.queue[i].ev.Op |= Remove
+			p.queue[i].deadline = time.Time{}
+		}
+	}
+	return p.ready()
+}
+
+// Remove and return all held events, without waiting for a pair.
+func (p *renamePairer) flush() []Event {
+	evs := make([]Event, 0, len(p.queue))
+	for _, h := range p.queue {
+		evs = append(evs, h.ev)
+	}
+	p.queue = nil
+	return evs
+}
+
+// Remove and return the events from the start of the queue that are no longer
+// waiting for a pair.
+func (p *renamePairer) ready() []Event {
+	n := 0
+	for n < len(p.queue) && p.queue[n].deadline.IsZero() {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	evs := make([]Event, 0, n)
+	for _, h := range p.queue[:n] {
+		evs = append(evs, h.ev)
+	}
+	p.queue = append(p.queue[:0], p.queue[n:]...)
+	return evs
+}
@@ -0,0 +1,251 @@
+package fsnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// parentWatches has the directories watched for WithNonExistent() and
+// WithFollowName().
+//
+// These are watched on the Watcher's own backend (or the polling backend for
+// WithPolling()), so they're counted in WatchCount() and WithMaxWatches(), but
+// they're not in WatchList(). Events for them are sent to the pending and
+// follow watches instead of the Events channel, unless the user watches the
+// path as well, in which case they're sent to both.
+type parentWatches struct {
+	w       *Watcher
+	done    chan struct{}
+	stopped chan struct{} // Closed when run() is done.
+
+	mu   sync.Mutex // Held while adding and removing watches.
+	dirs map[string]*parentDir
+
+	queueMu sync.Mutex // Separate from mu, as adding a watch may wait for an event to be sent.
+	queue   []Event
+	wakeup  chan struct{}
+}
+
+type parentDir struct {
+	b        backend // Backend it's watched on.
+	refs     int
+	op       Op            // Operations needed, for all refs.
+	interval time.Duration // WithPolling(); from the first add.
+	user     bool          // The user watches the path too, or it's part of a recursive watch.
+}
+
+func newParentWatches(w *Watcher) *parentWatches {
+	p := &parentWatches{
+		w:       w,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		dirs:    make(map[string]*parentDir),
+		wakeup:  make(chan struct{}, 1),
+	}
+	go p.run()
+	return p
+}
+
+// Stop sending events to the pending and follow watches; any events that are
+// queued are dropped.
+func (p *parentWatches) close() {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	<-p.stopped
+}
+
+// Queue an event for a parent directory. This is called from the backend's
+// goroutine, so it must never block.
+func (p *parentWatches) event(e Event) {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	p.queue = append(p.queue, e)
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Send the queued events to the pending and follow watches, in a separate
+// goroutine as they add and remove watches, which on Windows waits for the
+// backend's goroutine.
+func (p *parentWatches) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.wakeup:
+		}
+		p.queueMu.Lock()
+		q := p.queue
+		p.queue = nil
+		p.queueMu.Unlock()
+		for _, e := range q {
+			p.w.parentEvent(e)
+		}
+	}
+}
+
+// Get the backend to watch a directory on.
+func (p *parentWatches) backend(interval time.Duration) (backend, error) {
+	if _, ok := p.w.b.(*polling); !ok && interval > 0 {
+		return p.w.poller()
+	}
+	return p.w.b, nil
+}
+
+// Watch the directory for op. Adding a directory that's already watched adds a
+// reference, and adds op to the operations it's watched for.
+func (p *parentWatches) add(dir string, op Op, interval time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dirs[dir]
+	if ok && d.op&op == op {
+		d.refs++
+		return nil
+	}
+
+	var nd parentDir
+	if ok {
+		nd = *d
+		nd.op |= op
+	} else {
+		b, err := p.backend(interval)
+		if err != nil {
+			return err
+		}
+		nd = parentDir{b: b, op: op, interval: interval, user: p.watchedByUser(b, dir)}
+	}
+	if err := p.watch(dir, &nd); err != nil {
+		return err
+	}
+	nd.refs++
+	p.dirs[dir] = &nd
+	return nil
+}
+
+// Remove a reference to the directory, and stop watching it if there are none
+// left.
+func (p *parentWatches) remove(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dirs[dir]
+	if !ok {
+		return
+	}
+	if d.refs--; d.refs > 0 {
+		return
+	}
+	delete(p.dirs, dir)
+	// If the user watches it the watch is left alone; events for it are sent
+	// to run() until the user removes it, and are ignored by the pending and
+	// follow watches.
+	if !d.user {
+		_ = d.b.Remove(dir) // May already be gone.
+	}
+}
+
+func (p *parentWatches) watch(dir string, d *parentDir) error {
+	opts := []addOpt{WithOps(d.op), asParent(p, !d.user)}
+	if d.interval > 0 {
+		opts = append(opts, WithPolling(d.interval))
+	}
+	return d.b.AddWith(dir, opts...)
+}
+
+// Report if the user watches dir on the backend, either as the path itself or
+// as part of a recursive watch.
+func (p *parentWatches) watchedByUser(b backend, dir string) bool {
+	for _, path := range b.WatchList() {
+		root, recurse := recursivePath(path)
+		if d, ok := p.dirs[root]; ok && d.b == b && !d.user {
+			continue
+		}
+		if root == dir || recurse && hasPathPrefix(dir, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// The user added path to b; the parent directories it covers are now watched
+// by the user too.
+func (p *parentWatches) userAdded(b backend, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	root, recurse := recursivePath(path)
+	for dir, d := range p.dirs {
+		if d.b == b && (dir == root || recurse && hasPathPrefix(dir, root)) {
+			d.user = true
+		}
+	}
+}
+
+// The user removed path from b, which also removes the watches for the parent
+// directories it covers; add them again.
+func (p *parentWatches) userRemoved(b backend, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	root, _ := recursivePath(path)
+	for dir, d := range p.dirs {
+		if d.b == b && hasPathPrefix(dir, root) {
+			d.user = p.watchedByUser(b, dir)
+			_ = p.watch(dir, d) // May be gone, in which case a Remove was sent.
+		}
+	}
+}
+
+// Report if the path is only watched as a parent directory on b.
+func (p *parentWatches) only(b backend, path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dirs[path]
+	return ok && d.b == b && !d.user
+}
+
+// Remove the directories that are only watched as parent directories from a
+// WatchList() of b.
+func (p *parentWatches) filterList(b backend, l []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, path := range l {
+		if d, ok := p.dirs[path]; ok && d.b == b && !d.user {
+			continue
+		}
+		l[n] = path
+		n++
+	}
+	return l[:n]
+}
+
+// Get the number of watches on b that are only for parent directories.
+func (p *parentWatches) count(b backend) int {
+	if _, ok := b.(*polling); ok {
+		return 0 // Doesn't use watches.
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, d := range p.dirs {
+		if d.b == b && !d.user {
+			n++
+		}
+	}
+	return n
+}
+
+// asParent adds the path as a parent directory for p, rather than as a path
+// the user added. If only is true the user doesn't watch the path.
+func asParent(p *parentWatches, only bool) addOpt {
+	return func(opt *withOpts) { opt.parent, opt.parentOnly = p, only }
+}
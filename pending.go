@@ -0,0 +1,212 @@
+package fsnotify
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// pendingWatches has the paths added with WithNonExistent() that don't exist
+// yet.
+//
+// The nearest existing parent directory is watched as a parentWatches, and the
+// watch is moved down as directories are created. Once the path exists it's
+// added to the Watcher and a Create event is sent.
+type pendingWatches struct {
+	w       *Watcher       // Watcher to add the paths to.
+	out     *shared        // Send events and errors to w.
+	parents *parentWatches // Watches the parent directories.
+
+	mu    sync.Mutex
+	paths map[string]*pendingPath // Path as given to AddWith() → state.
+	dirs  map[string]int          // Watched parent → number of paths in it.
+}
+
+type pendingPath struct {
+	path   string   // As given to AddWith(), possibly with "/...".
+	target string   // Without "/...".
+	dir    string   // Watched parent directory; "" if not watched yet.
+	opts   []addOpt // Options to add the path with.
+	with   withOpts
+}
+
+func newPendingWatches(w *Watcher, parents *parentWatches) *pendingWatches {
+	return &pendingWatches{
+		w:       w,
+		out:     newShared(w.events, w.errors, w.backendSeq()),
+		parents: parents,
+		paths:   make(map[string]*pendingPath),
+		dirs:    make(map[string]int),
+	}
+}
+
+func (p *pendingWatches) close() { p.out.close() }
+
+// Add a path that doesn't exist yet. The path is added to the Watcher right
+// away if it was created in the meanwhile; no Create event is sent for this, as
+// it already existed by the time AddWith() returned.
+func (p *pendingWatches) add(path string, opts []addOpt, with withOpts) error {
+	target, _ := recursivePath(path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.paths[path]; ok {
+		return nil
+	}
+	pp := &pendingPath{path: path, target: target, opts: opts, with: with}
+	p.paths[path] = pp
+	_, err := p.resolve(pp)
+	return err
+}
+
+// Remove a pending path; returns false if it's not pending.
+func (p *pendingWatches) remove(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp, ok := p.paths[path]
+	if !ok {
+		return false
+	}
+	delete(p.paths, path)
+	p.unwatch(pp.dir)
+	return true
+}
+
+func (p *pendingWatches) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := make([]string, 0, len(p.paths))
+	for path := range p.paths {
+		l = append(l, path)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Handle an event for a parent directory. Returns false if the Watcher is
+// closed.
+func (p *pendingWatches) handle(e Event) bool {
+	if p.out.isClosed() {
+		return false
+	}
+	var (
+		evs  []Event
+		errs []error
+		todo []*pendingPath
+	)
+	p.mu.Lock()
+	// The watch is removed along with the directory, or is no longer for the
+	// same path if it was renamed.
+	if e.Has(Remove | Rename) {
+		for dir := range p.dirs {
+			if dir == e.Name || hasPathPrefix(dir, e.Name) {
+				delete(p.dirs, dir)
+				p.parents.remove(dir)
+			}
+		}
+	}
+	for _, pp := range p.paths {
+		created := e.Has(Create) && filepath.Dir(e.Name) == pp.dir &&
+			(e.Name == pp.target || hasPathPrefix(pp.target, e.Name))
+		removed := pp.dir != "" && p.dirs[pp.dir] == 0
+		if removed {
+			pp.dir = ""
+		}
+		if created || removed {
+			todo = append(todo, pp)
+		}
+	}
+	for _, pp := range todo {
+		ev, err := p.resolve(pp)
+		evs = append(evs, ev...)
+		if err != nil {
+			errs = append(errs, watchError("add", pp.path, err))
+		}
+	}
+	p.mu.Unlock()
+
+	for _, err := range errs {
+		if !p.out.sendError(err) {
+			return false
+		}
+	}
+	for _, e := range evs {
+		if !p.out.sendEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add the path to the Watcher if it exists, or otherwise watch the nearest
+// existing parent directory. Returns the Create event to send if the path was
+// added.
+//
+// The path is removed from the pending paths if it can't be added, or if there
+// was an error watching the parent.
+func (p *pendingWatches) resolve(pp *pendingPath) ([]Event, error) {
+	for {
+		fi, err := os.Stat(pp.target)
+		if err == nil {
+			err = p.w.add(pp.path, pp.opts, pp.with)
+			if !errors.Is(err, fs.ErrNotExist) {
+				delete(p.paths, pp.path)
+				p.unwatch(pp.dir)
+				if err != nil {
+					return nil, err
+				}
+				return []Event{{Name: pp.target, Op: Create, IsDir: fi.IsDir()}}, nil
+			}
+			// Removed again right away; keep waiting.
+		}
+
+		dir := nearestDir(pp.target)
+		if dir == pp.dir {
+			return nil, nil
+		}
+		if err := p.watch(dir, pp.with); err != nil {
+			delete(p.paths, pp.path)
+			p.unwatch(pp.dir)
+			return nil, err
+		}
+		p.unwatch(pp.dir)
+		pp.dir = dir
+		// Check again, as something may have been created before the watch was
+		// set up.
+	}
+}
+
+func (p *pendingWatches) watch(dir string, with withOpts) error {
+	if p.dirs[dir] == 0 {
+		if err := p.parents.add(dir, Create|Remove|Rename, with.pollInterval); err != nil {
+			return err
+		}
+	}
+	p.dirs[dir]++
+	return nil
+}
+
+func (p *pendingWatches) unwatch(dir string) {
+	if dir == "" {
+		return
+	}
+	p.dirs[dir]--
+	if p.dirs[dir] <= 0 {
+		delete(p.dirs, dir)
+		p.parents.remove(dir)
+	}
+}
+
+// Get the nearest parent directory of path that exists.
+func nearestDir(path string) string {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+		if d := filepath.Dir(dir); d == dir {
+			return dir
+		}
+	}
+}
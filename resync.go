@@ -0,0 +1,162 @@
+package fsnotify
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// resyncer keeps a snapshot of all watched paths, so that we can rescan them
+// after an ErrEventOverflow and send events for everything that was missed.
+//
+// The snapshots are kept up to date from the events we send, rather than
+// rescanning, so that a resync only sends events that weren't already sent.
+type resyncer struct {
+	mu    sync.Mutex
+	roots map[string]*resyncRoot // Watched path → state.
+}
+
+type resyncRoot struct {
+	recurse bool
+	op      Op
+	filter  *pathFilter
+	stat    bool // WithStat()
+	snap    snapshot
+}
+
+func newResyncer() *resyncer {
+	return &resyncer{roots: make(map[string]*resyncRoot)}
+}
+
+// Add a watched path. Errors are ignored, as the path was already added to the
+// backend: if the path is removed in the meanwhile we'll get an event for it.
+func (r *resyncer) add(path string, with withOpts) {
+	path, recurse := recursivePath(path)
+	filter := newPathFilter(with)
+	snap, err := takeSnapshot(path, recurse, filter.skipFunc(path))
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op := with.op
+	if rr, ok := r.roots[path]; ok {
+		op |= rr.op
+		rr.filter.close()
+	}
+	r.roots[path] = &resyncRoot{recurse: recurse, op: op, filter: filter, stat: with.stat, snap: snap}
+}
+
+func (r *resyncer) remove(path string) {
+	path, _ = recursivePath(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rr, ok := r.roots[path]; ok {
+		rr.filter.close()
+		delete(r.roots, path)
+	}
+}
+
+// Stop using the filters, when the Watcher is closed.
+func (r *resyncer) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rr := range r.roots {
+		rr.filter.close()
+	}
+}
+
+// Update the snapshots for an event we're about to send.
+func (r *resyncer) update(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for root, rr := range r.roots {
+		if !rr.covers(root, e.Name) {
+			continue
+		}
+		rr.filter.changed(root, e.Name)
+
+		if e.Has(Remove | Rename) {
+			if e.Name == root {
+				rr.filter.close()
+				delete(r.roots, root)
+				continue
+			}
+			rr.snap.remove(e.Name)
+		}
+		if e.Has(Create | Write | Chmod) {
+			fi, err := os.Lstat(e.Name)
+			if err != nil {
+				continue
+			}
+			rr.snap[e.Name] = newFileState(fi)
+			// Directory moved in or created with "mkdir -p"; we may not get
+			// events for everything in it.
+			if rr.recurse && fi.IsDir() && e.Has(Create) && e.Name != root {
+				sub, err := takeSnapshot(e.Name, true, rr.filter.skipFunc(root))
+				if err == nil {
+					for p, st := range sub {
+						rr.snap[p] = st
+					}
+				}
+			}
+		}
+	}
+}
+
+// Report if the path is included in the snapshot for this root.
+func (rr *resyncRoot) covers(root, path string) bool {
+	if rr.recurse {
+		return hasPathPrefix(path, root)
+	}
+	return path == root || filepath.Dir(path) == root
+}
+
+// Remove the path, and everything in it if it's a directory.
+func (s snapshot) remove(path string) {
+	st, ok := s[path]
+	delete(s, path)
+	if ok && st.isDir() {
+		for p := range s {
+			if hasPathPrefix(p, path) {
+				delete(s, p)
+			}
+		}
+	}
+}
+
+// Rescan all watched paths, and return the events for everything that
+// changed.
+func (r *resyncer) resync() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var evs []Event
+	for root, rr := range r.roots {
+		snap, err := takeSnapshot(root, rr.recurse, rr.filter.skipFunc(root))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		for _, e := range rr.snap.diff(snap) {
+			e.Op &= rr.op
+			if e.Op == 0 || rr.filter.skip(root, e.Name, nil) {
+				continue
+			}
+			if rr.stat && e.Op&^(Remove|Rename) != 0 {
+				if fi, err := os.Lstat(e.Name); err == nil {
+					e.Stat = fi
+				}
+			}
+			evs = append(evs, e)
+		}
+		rr.snap = snap
+		if snap == nil {
+			rr.filter.close()
+			delete(r.roots, root)
+		}
+	}
+	return evs
+}
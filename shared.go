@@ -1,27 +1,44 @@
 package fsnotify
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type shared struct {
 	Events chan Event
 	Errors chan error
+	seq    *sequence
 	done   chan struct{}
 	mu     sync.Mutex
+
+	filters    filterSet // Filters set with WithInclude() and WithExclude().
+	maxWatches int       // Set with WithMaxWatches(); 0 if there is no maximum.
+	log        logger
+	stats      statCounters
+	existing   []Event // Events for WithExisting() to send before anything else; must hold mu.
 }
 
-func newShared(ev chan Event, errs chan error) *shared {
+func newShared(ev chan Event, errs chan error, seq *sequence) *shared {
 	return &shared{
 		Events: ev,
 		Errors: errs,
+		seq:    seq,
 		done:   make(chan struct{}),
 	}
 }
 
 // Returns true if the event was sent, or false if watcher is closed.
 func (w *shared) sendEvent(e Event) bool {
-	if e.Op == 0 {
+	if e.Op == 0 || !w.filters.apply(&e) {
+		w.stats.filtered.Add(1)
 		return true
 	}
+	w.seq.stamp(&e)
+	w.stats.sent.Add(1) // Before sending, so that it's counted once received.
 	select {
 	case <-w.done:
 		return false
@@ -35,6 +52,8 @@ func (w *shared) sendError(err error) bool {
 	if err == nil {
 		return true
 	}
+	w.log.error(err)
+	w.stats.error(err)
 	select {
 	case <-w.done:
 		return false
@@ -43,6 +62,61 @@ func (w *shared) sendError(err error) bool {
 	}
 }
 
+func (w *shared) counters() *statCounters { return &w.stats }
+
+// Queue the events for WithExisting() and WithStateFile() for a path that was
+// just added; must hold mu. Returns false if there is nothing to send.
+func (w *shared) queueExisting(path string, recurse bool, with withOpts) bool {
+	if !with.existing && with.saved == nil {
+		return false
+	}
+	f := newPathFilter(with)
+	defer f.close()
+	snap, err := takeSnapshot(path, recurse, f.skipFunc(path))
+	if err != nil { // Removed already; we'll get an event for that.
+		return false
+	}
+	w.existing = append(w.existing, existingEvents(path, snap, with)...)
+	return len(w.existing) > 0
+}
+
+// Get the events for WithExisting() and WithStateFile() for the snapshot of a
+// path that was just added: the changes since the saved state if there is one,
+// or a Create for everything in it.
+func existingEvents(path string, snap snapshot, with withOpts) []Event {
+	var evs []Event
+	switch {
+	case with.saved != nil:
+		evs = with.saved.diff(snap)
+	case with.existing:
+		evs = snap.created(path)
+	}
+	n := 0
+	for _, e := range evs {
+		if e.Op &= with.op; e.Op != 0 {
+			evs[n] = e
+			n++
+		}
+	}
+	return evs[:n]
+}
+
+// Send the events queued for WithExisting(). This needs to be called after
+// reading events from the kernel and before handling them, so that the queued
+// events are sent first if the events were read after the listing.
+func (w *shared) sendExisting() bool {
+	w.mu.Lock()
+	evs := w.existing
+	w.existing = nil
+	w.mu.Unlock()
+	for _, e := range evs {
+		if !w.sendEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
 func (w *shared) isClosed() bool {
 	select {
 	case <-w.done:
@@ -60,5 +134,64 @@ func (w *shared) close() bool {
 		return true
 	}
 	close(w.done)
+	w.filters.close()
 	return false
 }
+
+// Set the options from NewWatcherWith(); this is called before any watches
+// are added.
+func (w *shared) setOpts(opts watcherOpts) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxWatches = opts.maxWatches
+	w.log.set(opts.logger)
+}
+
+// Get the error for adding a watch if n watches are already in use and the
+// maximum set with WithMaxWatches() is reached.
+func checkMaxWatches(n, limit int) error {
+	if limit > 0 && n >= limit {
+		return fmt.Errorf("%w: WithMaxWatches(%d)", ErrWatchLimit, limit)
+	}
+	return nil
+}
+
+// statCounters has the counters for Stats.
+type statCounters struct {
+	read, sent, filtered, overflows, errors, bytes atomic.Uint64
+}
+
+// Count an error; this is done before sending it, as it's counted even if no
+// one is reading the Errors channel.
+func (c *statCounters) error(err error) {
+	c.errors.Add(1)
+	if errors.Is(err, ErrEventOverflow) {
+		c.overflows.Add(1)
+	}
+}
+
+// Add the counters to s.
+func (c *statCounters) add(s *Stats) {
+	s.EventsRead += c.read.Load()
+	s.EventsSent += c.sent.Load()
+	s.EventsFiltered += c.filtered.Load()
+	s.Overflows += c.overflows.Load()
+	s.Errors += c.errors.Load()
+	s.BytesRead += c.bytes.Load()
+}
+
+// sequence sets Event.Seq; it's shared by all backends of a Watcher, so that
+// the numbers are unique for the Watcher. This is nil if the events are
+// forwarded, in which case forward() sets it.
+type sequence struct{ n atomic.Uint64 }
+
+// Set the sequence number, and set the time to now if the backend didn't
+// already set it.
+func (s *sequence) stamp(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if s != nil {
+		e.Seq = s.n.Add(1)
+	}
+}
@@ -0,0 +1,209 @@
+package fsnotify
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type (
+	// snapshot of a watched path, as path → state.
+	snapshot  map[string]fileState
+	fileState struct {
+		mode     fs.FileMode
+		size     int64
+		mtime    time.Time
+		dev, ino uint64 // 0 if not known.
+	}
+)
+
+func newFileState(fi fs.FileInfo) fileState {
+	dev, ino := fileInode(fi)
+	return fileState{mode: fi.Mode(), size: fi.Size(), mtime: fi.ModTime(), dev: dev, ino: ino}
+}
+
+func (s fileState) isDir() bool { return s.mode.IsDir() }
+
+// Same file if the inode is the same; always false if we don't know the inode.
+func (s fileState) sameFile(o fileState) bool {
+	return s.ino != 0 && s.dev == o.dev && s.ino == o.ino
+}
+
+// Report if o is s after a rename. Inode numbers can be re-used after a file is
+// removed, so also make sure nothing else changed.
+func (s fileState) renamed(o fileState) bool {
+	return s.sameFile(o) && s.mode == o.mode &&
+		(s.isDir() || (s.size == o.size && s.mtime.Equal(o.mtime)))
+}
+
+// takeSnapshot records the state of root, and everything in it if it's a
+// directory. Subdirectories are only included if recurse is set. Paths for which
+// skip returns true aren't included, and excluded directories aren't read; skip
+// may be nil.
+//
+// Returns an error wrapping fs.ErrNotExist if root doesn't exist. Errors for
+// anything below root are ignored, as it may be removed while we're reading
+// it.
+func takeSnapshot(root string, recurse bool, skip func(string, func() bool) bool) (snapshot, error) {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := snapshot{root: newFileState(fi)}
+	if !fi.IsDir() {
+		return snap, nil
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		if skip != nil && skip(path, d.IsDir) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		snap[path] = newFileState(fi)
+		if d.IsDir() && !recurse {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// created returns a Create event for everything in s, with parent directories
+// before the paths in them. root itself is only included if it's a file.
+func (s snapshot) created(root string) []Event {
+	evs := make([]Event, 0, len(s))
+	for path, st := range s {
+		if path != root || !st.isDir() {
+			evs = append(evs, Event{Name: path, Op: Create, IsDir: st.isDir()})
+		}
+	}
+	sort.Slice(evs, func(i, j int) bool { return evs[i].Name < evs[j].Name })
+	return evs
+}
+
+// diff returns the events to get from the state in s to the state in newer.
+//
+// Renames are detected by the inode number: a path that's gone and a new path
+// with the same inode (and the same size and mtime) is sent as a Rename for the
+// old path followed by a Create with RenamedFrom set. Paths inside a renamed
+// directory don't get their own events.
+func (s snapshot) diff(newer snapshot) []Event {
+	var (
+		removed = make([]string, 0, 4)
+		created = make([]string, 0, 4)
+		changed = make([]Event, 0, 4)
+	)
+	for path, old := range s {
+		cur, ok := newer[path]
+		switch {
+		case !ok:
+			removed = append(removed, path)
+		case old.ino != 0 && !old.sameFile(cur):
+			// Replaced by a different file; e.g. "rm file; touch file", or an
+			// editor writing to a temporary file and renaming it over this
+			// one.
+			removed = append(removed, path)
+			created = append(created, path)
+		default:
+			var op Op
+			if !cur.isDir() && (cur.size != old.size || !cur.mtime.Equal(old.mtime)) {
+				op |= Write
+			}
+			if cur.mode != old.mode {
+				op |= Chmod
+			}
+			if op != 0 {
+				changed = append(changed, Event{Name: path, Op: op, IsDir: cur.isDir()})
+			}
+		}
+	}
+	for path := range newer {
+		if _, ok := s[path]; !ok {
+			created = append(created, path)
+		}
+	}
+
+	// Sort so that parents are created before their children, and children
+	// are removed before their parents.
+	sort.Strings(created)
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+
+	// Pair up removed and created paths with the same inode as renames.
+	var (
+		renames   = make(map[string]string) // old → new
+		renamedTo = make(map[string]string) // new → old
+	)
+	for _, path := range removed {
+		old := s[path]
+		if old.ino == 0 {
+			continue
+		}
+		for _, c := range created {
+			if _, ok := renamedTo[c]; !ok && old.renamed(newer[c]) {
+				renames[path], renamedTo[c] = c, path
+				break
+			}
+		}
+	}
+	// Paths that moved along with their parent directory.
+	implied := func(from, to string) bool {
+		for p, dir := from, filepath.Dir(from); dir != p; p, dir = dir, filepath.Dir(dir) {
+			if newDir, ok := renames[dir]; ok && s[dir].isDir() && to == newDir+from[len(dir):] {
+				return true
+			}
+		}
+		return false
+	}
+
+	evs := make([]Event, 0, len(removed)+len(created)+len(changed))
+	for _, path := range removed {
+		to, ok := renames[path]
+		_, overwritten := renamedTo[path]
+		switch {
+		case overwritten && !ok:
+			// Another file was renamed over this one; the Rename and Create
+			// are enough.
+		case ok && implied(path, to):
+			// Nothing to send; the event for the directory is enough.
+		case ok:
+			evs = append(evs, Event{Name: path, Op: Rename, IsDir: s[path].isDir()})
+		default:
+			evs = append(evs, Event{Name: path, Op: Remove, IsDir: s[path].isDir()})
+		}
+	}
+	for _, path := range created {
+		from, ok := renamedTo[path]
+		switch {
+		case ok && implied(from, path):
+			// Nothing to send; the event for the directory is enough.
+		case ok:
+			evs = append(evs, Event{Name: path, Op: Create, RenamedFrom: from, IsDir: newer[path].isDir()})
+		default:
+			evs = append(evs, Event{Name: path, Op: Create, IsDir: newer[path].isDir()})
+		}
+	}
+	return append(evs, changed...)
+}
@@ -0,0 +1,136 @@
+package fsnotify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateStore keeps the snapshots of the watched paths in a file, so that
+// changes made while the program wasn't running can be sent when the paths are
+// added again; see WithStateFile().
+type stateStore struct {
+	file  string
+	mu    sync.Mutex
+	saved map[string]stateRoot // Roots from the file that weren't added yet.
+}
+
+// Format of the state file. The version is increased on incompatible changes,
+// in which case the file is ignored.
+type (
+	stateFile struct {
+		Version int                  `json:"version"`
+		Roots   map[string]stateRoot `json:"roots"`
+	}
+	stateRoot struct {
+		Recurse bool                  `json:"recurse,omitempty"`
+		Paths   map[string]stateEntry `json:"paths"`
+	}
+	stateEntry struct {
+		Mode  fs.FileMode `json:"mode"`
+		Size  int64       `json:"size"`
+		Mtime time.Time   `json:"mtime"`
+		Dev   uint64      `json:"dev,omitempty"`
+		Ino   uint64      `json:"ino,omitempty"`
+	}
+)
+
+const stateVersion = 1
+
+// Load the state file; it's not an error if it doesn't exist yet.
+func loadState(file string) (*stateStore, error) {
+	s := &stateStore{file: file, saved: make(map[string]stateRoot)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: reading state file: %w", err)
+	}
+
+	var sf stateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("fsnotify: reading state file %q: %w", file, err)
+	}
+	if sf.Version == stateVersion && sf.Roots != nil {
+		s.saved = sf.Roots
+	}
+	return s, nil
+}
+
+// Get the saved snapshot for a path that's being added, or nil if there isn't
+// one.
+func (s *stateStore) get(path string) snapshot {
+	path, recurse := recursivePath(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root, ok := s.saved[path]
+	if !ok || root.Recurse != recurse {
+		return nil
+	}
+
+	snap := make(snapshot, len(root.Paths))
+	for p, e := range root.Paths {
+		snap[p] = fileState{mode: e.Mode, size: e.Size, mtime: e.Mtime, dev: e.Dev, ino: e.Ino}
+	}
+	return snap
+}
+
+// Forget the saved state for a path; this is done once it's added, after which
+// the state comes from the resyncer, and when it's removed with Remove().
+func (s *stateStore) remove(path string) {
+	path, _ = recursivePath(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.saved, path)
+}
+
+// Write the current state of all watched paths, along with the saved state for
+// paths that weren't added. The file is written to a temporary file first and
+// renamed, so it's never left half-written.
+func (s *stateStore) save(r *resyncer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.mu.Lock()
+	sf := stateFile{Version: stateVersion, Roots: make(map[string]stateRoot, len(s.saved)+len(r.roots))}
+	for p, root := range s.saved {
+		sf.Roots[p] = root
+	}
+	for p, rr := range r.roots {
+		root := stateRoot{Recurse: rr.recurse, Paths: make(map[string]stateEntry, len(rr.snap))}
+		for p, st := range rr.snap {
+			root.Paths[p] = stateEntry{Mode: st.mode, Size: st.size, Mtime: st.mtime, Dev: st.dev, Ino: st.ino}
+		}
+		sf.Roots[p] = root
+	}
+	r.mu.Unlock()
+
+	data, err := json.Marshal(sf)
+	if err != nil {
+		return fmt.Errorf("fsnotify: writing state file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".*")
+	if err != nil {
+		return fmt.Errorf("fsnotify: writing state file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("fsnotify: writing state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Subscription receives the events for a part of the watched paths; see
+// [Watcher.Subscribe].
+type Subscription struct {
+	// Events sends the events for paths in the subscription's prefix, with
+	// only the operations it was created with.
+	Events <-chan Event
+
+	// Errors sends errors for paths in the subscription's prefix, and all
+	// errors that aren't for a specific path, such as [ErrEventOverflow].
+	Errors <-chan error
+
+	w      *Watcher
+	prefix string
+	ops    Op
+	events chan Event
+	errors chan error
+	done   chan struct{} // Closed to stop a send that's blocked.
+	stop   sync.Once
+
+	mu     sync.Mutex // Held while sending, so the channels aren't closed while sending.
+	closed bool
+}
+
+// Subscribe returns a Subscription that receives the events for paths that
+// start with pathPrefix (which may be the path itself, or a directory it's
+// in), with only the operations in ops. An empty pathPrefix receives the
+// events for all paths, and ops of 0 receives all operations.
+//
+// This allows several independent parts of a program to share a single
+// Watcher, rather than each creating their own (which uses an inotify instance
+// on Linux, of which there is a limited number). Subscribe doesn't add any
+// watches: use [Watcher.Add] or [Watcher.AddWith] to watch the paths. Events
+// are matched on [Event.Name], so the prefix should be in the same form as the
+// paths that were added (i.e. both relative or both absolute).
+//
+// The first call to Subscribe starts reading the Watcher's Events and Errors
+// channels to send the events and errors on to the subscriptions; nothing
+// should read from these channels directly after that, or use [Watcher.Next]
+// or [Watcher.Run]. Events that don't match any subscription are dropped.
+//
+// Every event is sent on the subscriptions in the order they were created,
+// and the next event isn't read until all subscriptions have received it: a
+// subscription that isn't read blocks all others. Errors don't block: they're
+// dropped if the subscription's Errors channel isn't read. The channels use
+// the same buffer size as the Watcher's Events channel (see
+// [NewBufferedWatcher]).
+//
+// The channels are closed when the subscription is closed with
+// [Subscription.Close], or when the Watcher is closed. Returns [ErrClosed] if
+// the Watcher is closed.
+func (w *Watcher) Subscribe(pathPrefix string, ops Op) (*Subscription, error) {
+	if w.handler != nil {
+		return nil, fmt.Errorf("%w: Subscribe can't be used with WithHandler", ErrUnsupported)
+	}
+	if pathPrefix != "" {
+		pathPrefix = filepath.Clean(pathPrefix)
+	}
+	s := &Subscription{
+		w:      w,
+		prefix: pathPrefix,
+		ops:    ops,
+		events: make(chan Event, w.opts.bufsize),
+		errors: make(chan error, w.opts.bufsize),
+		done:   make(chan struct{}),
+	}
+	s.Events, s.Errors = s.events, s.errors
+
+	w.subMu.Lock()
+	defer w.subMu.Unlock()
+	w.pollMu.Lock() // Close() sets closed before cancelSubscriptions().
+	closed := w.closed
+	w.pollMu.Unlock()
+	if w.subsDone || closed {
+		return nil, ErrClosed
+	}
+	if !w.subsStarted {
+		w.subsStarted = true
+		go w.dispatch()
+	}
+	w.subs = append(w.subs, s)
+	return s, nil
+}
+
+// Close the subscription and its channels. Other subscriptions and the Watcher
+// aren't affected; it's not an error to call Close more than once.
+func (s *Subscription) Close() error {
+	s.w.subMu.Lock()
+	for i, ss := range s.w.subs {
+		if ss == s {
+			s.w.subs = append(s.w.subs[:i:i], s.w.subs[i+1:]...)
+			break
+		}
+	}
+	s.w.subMu.Unlock()
+	s.close()
+	return nil
+}
+
+// Stop sending on the subscription; anything that's sent after this is
+// dropped.
+func (s *Subscription) cancel() { s.stop.Do(func() { close(s.done) }) }
+
+func (s *Subscription) close() {
+	s.cancel() // Before getting the lock, as sendEvent() holds it while blocked.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+		close(s.errors)
+	}
+}
+
+// Report if the path is in the subscription's prefix.
+func (s *Subscription) covers(path string) bool {
+	return s.prefix == "" || hasPathPrefix(path, s.prefix) ||
+		(strings.HasSuffix(s.prefix, string(os.PathSeparator)) && strings.HasPrefix(path, s.prefix))
+}
+
+// Send the event on the subscription if it matches.
+func (s *Subscription) sendEvent(e Event) {
+	if s.ops != 0 {
+		if e.Op &= s.ops; e.Op == 0 {
+			return
+		}
+	}
+	if !s.covers(e.Name) && (e.RenamedFrom == "" || !s.covers(e.RenamedFrom)) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- e:
+	case <-s.done:
+	}
+}
+
+// Send the error on the subscription if it's not for a path outside the
+// prefix. The error is dropped if the Errors channel isn't read, as many
+// programs only read Events.
+func (s *Subscription) sendError(err error) {
+	var we *WatchError
+	if errors.As(err, &we) && !s.covers(we.Path) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+// Read the Watcher's Events and Errors channels and send everything on to the
+// subscriptions, until the Watcher is closed.
+func (w *Watcher) dispatch() {
+	var (
+		events = w.Events
+		errs   = w.Errors
+	)
+	for events != nil || errs != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			for _, s := range w.subscriptions() {
+				s.sendEvent(e)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			for _, s := range w.subscriptions() {
+				s.sendError(err)
+			}
+		}
+	}
+
+	w.subMu.Lock()
+	subs := w.subs
+	w.subs, w.subsDone = nil, true
+	w.subMu.Unlock()
+	for _, s := range subs {
+		s.close()
+	}
+}
+
+func (w *Watcher) subscriptions() []*Subscription {
+	w.subMu.Lock()
+	defer w.subMu.Unlock()
+	return w.subs
+}
+
+// Stop sending on all subscriptions, so that an unread subscription doesn't
+// keep dispatch() running after Close().
+func (w *Watcher) cancelSubscriptions() {
+	for _, s := range w.subscriptions() {
+		s.cancel()
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package fsnotify
+
+import "io/fs"
+
+// Get the device and inode number of a file, or 0 if it's not known.
+//
+// os.Lstat() doesn't return this on Windows and plan9, so it's always 0.
+func fileInode(fi fs.FileInfo) (dev, ino uint64) { return 0, 0 }
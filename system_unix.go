@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package fsnotify
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Get the device and inode number of a file, or 0 if it's not known.
+func fileInode(fi fs.FileInfo) (dev, ino uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino)
+}